@@ -0,0 +1,26 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned when no blob is stored under the key
+var ErrNotFound = errors.New("blob not found")
+
+// Info describes a stored blob
+type Info struct {
+	Name string // Original file name
+	MIME string
+	Size int64
+}
+
+// BlobStore represents an interface for storing uploaded files,
+// blobs are addressed by slash-separated keys, e.g. "<topic>/<id>"
+type BlobStore interface {
+	// Put stores info.Size bytes read from r under the key
+	Put(ctx context.Context, key string, r io.Reader, info Info) error
+	// Get opens the blob stored under the key, the caller must close the reader
+	Get(ctx context.Context, key string) (io.ReadCloser, Info, error)
+}
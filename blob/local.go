@@ -0,0 +1,105 @@
+package blob
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// LocalStore implements the BlobStore interface on the local filesystem.
+// Every blob is a file with a JSON sidecar holding its Info.
+type LocalStore struct {
+	dir string
+}
+
+var _ BlobStore = (*LocalStore)(nil)
+
+// NewLocalStore creates a LocalStore keeping blobs in dir, the directory is created if missing
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+// path returns the file the blob is stored in, keys must not escape the store's directory
+func (s *LocalStore) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob to a temporary file and moves it in place once complete.
+// The sidecar is written last, so failed uploads leave nothing behind.
+func (s *LocalStore) Put(_ context.Context, key string, r io.Reader, info Info) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path+".json", meta, 0o640); err != nil {
+		// a blob without its sidecar can not be served
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// Get opens the blob's file
+func (s *LocalStore) Get(_ context.Context, key string) (io.ReadCloser, Info, error) {
+	var info Info
+
+	path, err := s.path(key)
+	if err != nil {
+		return nil, info, ErrNotFound
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, info, ErrNotFound
+	}
+	if err != nil {
+		return nil, info, err
+	}
+
+	meta, err := os.ReadFile(path + ".json")
+	if err == nil {
+		err = json.Unmarshal(meta, &info)
+	}
+	if err != nil {
+		f.Close()
+		return nil, info, err
+	}
+	return f, info, nil
+}
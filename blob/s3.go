@@ -0,0 +1,85 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"net/url"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config holds the connection settings of an S3-compatible object storage, e.g. AWS S3 or MinIO
+type S3Config struct {
+	Endpoint  string // host[:port] without scheme
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	UseSSL    bool
+}
+
+// S3Store implements the BlobStore interface on top of an S3-compatible object storage
+type S3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+var _ BlobStore = (*S3Store)(nil)
+
+// NewS3Store connects to the object storage and creates the bucket if it does not exist
+func NewS3Store(ctx context.Context, cfg S3Config) (*S3Store, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &S3Store{client: client, bucket: cfg.Bucket}, nil
+}
+
+// Put uploads the blob as an object, the file name is kept in the object's metadata
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, info Info) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, info.Size, minio.PutObjectOptions{
+		ContentType: info.MIME,
+		// metadata is sent as HTTP headers, which only allow ASCII
+		UserMetadata: map[string]string{"name": url.QueryEscape(info.Name)},
+	})
+	return err
+}
+
+// Get downloads the object
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, Info, error) {
+	var info Info
+
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, info, err
+	}
+
+	// the object is requested lazily, missing objects are reported by Stat
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, info, ErrNotFound
+		}
+		return nil, info, err
+	}
+
+	info.MIME = stat.ContentType
+	info.Size = stat.Size
+	info.Name, _ = url.QueryUnescape(stat.UserMetadata["Name"])
+	return obj, info, nil
+}
@@ -1,15 +1,13 @@
 package controllers
 
 import (
-	"fmt"
+	"errors"
+	"log/slog"
 	"net/http"
-	"os"
 
 	"github.com/dartt0n/realtime-chat-backend/forms"
-	"github.com/dartt0n/realtime-chat-backend/models"
 	"github.com/dartt0n/realtime-chat-backend/service"
 	"github.com/gin-gonic/gin"
-	jwt "github.com/golang-jwt/jwt/v4"
 )
 
 // AuthController handles authentication related operations
@@ -39,8 +37,15 @@ func (ctrl AuthController) TokenValid(c *gin.Context) {
 		return
 	}
 
-	// To be called from GetUserID()
+	// last use is listed with the sessions, failing to record it must not fail the request
+	if err := ctrl.auth.TouchSession(tokenAuth.FamilyID); err != nil {
+		slog.Warn("failed to record session use", "error", err, "family_id", tokenAuth.FamilyID)
+	}
+
+	// To be called from getUserID(), getAccessUUID() and getSessionID()
 	c.Set("userID", userID)
+	c.Set("accessUUID", tokenAuth.AccessUUID)
+	c.Set("sessionID", tokenAuth.FamilyID)
 }
 
 // Refresh handles the token refresh operation by validating the refresh token
@@ -54,65 +59,27 @@ func (ctrl AuthController) Refresh(c *gin.Context) {
 		return
 	}
 
-	// verify the token
-	token, err := jwt.Parse(tokenForm.RefreshToken, func(token *jwt.Token) (interface{}, error) {
-		// Make sure that the token method conform to "SigningMethodHMAC"
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(os.Getenv("REFRESH_SECRET")), nil
-	})
-	// if there is an error, the token must have expired
-	if err != nil {
+	// the old pair is invalidated, a reused token revokes all tokens issued since the login
+	ts, err := ctrl.auth.Refresh(tokenForm.RefreshToken)
+	if errors.Is(err, service.ErrInvalidToken) || errors.Is(err, service.ErrTokenReuse) {
 		c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid authorization, please login again"})
 		return
 	}
-	// is token valid?
-	if _, ok := token.Claims.(jwt.Claims); !ok && !token.Valid {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid authorization, please login again"})
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"message": "Invalid authorization, please login again"})
 		return
 	}
-	// Since token is valid, get the uuid:
-	claims, ok := token.Claims.(jwt.MapClaims) // the token claims should conform to MapClaims
-	if ok && token.Valid {
-		refreshUUID, ok := claims["refresh_uuid"].(string) // convert the interface to string
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid authorization, please login again"})
-			return
-		}
-
-		userID, err := models.ParseUserID(claims["user_id"].(string))
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid authorization, please login again"})
-			return
-		}
 
-		// Delete the previous Refresh Token
-		_, delErr := ctrl.auth.DeleteAuth(refreshUUID)
-		if delErr != nil { // if any goes wrong
-			c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid authorization, please login again"})
-			return
-		}
-
-		// Create new pairs of refresh and access tokens
-		ts, createErr := ctrl.auth.CreateToken(userID)
-		if createErr != nil {
-			c.JSON(http.StatusForbidden, gin.H{"message": "Invalid authorization, please login again"})
-			return
-		}
-
-		// save the tokens metadata to redis
-		saveErr := ctrl.auth.CreateAuth(userID, ts)
-		if saveErr != nil {
-			c.JSON(http.StatusForbidden, gin.H{"message": "Invalid authorization, please login again"})
-			return
-		}
-		tokens := map[string]string{
-			"access_token":  ts.AccessToken,
-			"refresh_token": ts.RefreshToken,
-		}
-		c.JSON(http.StatusOK, tokens)
-	} else {
-		c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid authorization, please login again"})
+	tokens := map[string]string{
+		"access_token":  ts.AccessToken,
+		"refresh_token": ts.RefreshToken,
 	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// JWKS serves the public keys tokens are signed with, so other services can verify them
+func (ctrl AuthController) JWKS(c *gin.Context) {
+	// verifiers may cache the keys, new keys are published before they sign any token
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, ctrl.auth.JWKS())
 }
@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/dartt0n/realtime-chat-backend/service"
+)
+
+// errorStatus maps service errors to HTTP status codes, falling back to the given status
+func errorStatus(err error, fallback int) int {
+	var connErr *service.ConnError
+	if errors.As(err, &connErr) {
+		// Tinode is unreachable at the moment, the client may retry later
+		return http.StatusServiceUnavailable
+	}
+
+	if errors.Is(err, service.ErrUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, service.ErrForbidden) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, service.ErrNotFound) {
+		return http.StatusNotFound
+	}
+
+	var ctrlErr *service.CtrlError
+	if errors.As(err, &ctrlErr) {
+		// client errors are passed through, server errors belong to Tinode, not to us
+		if ctrlErr.Code >= 400 && ctrlErr.Code < 500 {
+			return int(ctrlErr.Code)
+		}
+		return http.StatusBadGateway
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	return fallback
+}
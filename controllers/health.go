@@ -1,18 +1,36 @@
 package controllers
 
-import "github.com/gin-gonic/gin"
+import (
+	"net/http"
+
+	"github.com/dartt0n/realtime-chat-backend/service"
+	"github.com/gin-gonic/gin"
+)
 
 // HealthController represents a controller for health check endpoints
-type HealthController struct{}
+type HealthController struct {
+	tinode *service.TinodeService
+}
 
-func NewHealthController() *HealthController {
-	return &HealthController{}
+func NewHealthController(tinode *service.TinodeService) *HealthController {
+	return &HealthController{tinode: tinode}
 }
 
 // Health handles the health check endpoint and returns a 200 OK response
-// with a status message indicating the service is healthy
+// with a status message indicating the service is healthy, or 503 Service Unavailable
+// while the connection to Tinode is being re-established
 func (ctrl HealthController) Health(c *gin.Context) {
-	c.JSON(200, gin.H{
+	tinode := ctrl.tinode.Health()
+	if tinode.State != service.StateConnected {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": "degraded",
+			"tinode": tinode,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
 		"status": "ok",
+		"tinode": tinode,
 	})
 }
@@ -2,8 +2,10 @@ package controllers
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/models"
 	"github.com/dartt0n/realtime-chat-backend/service"
 	"github.com/gin-gonic/gin"
 )
@@ -19,26 +21,107 @@ func NewMessageController(tinode *service.TinodeService, auth *service.AuthServi
 	return &MessageController{tinode: tinode, auth: auth}
 }
 
-func (ctrl MessageController) FetchLast(c *gin.Context) {
-	_, err := ctrl.auth.ExtractTokenMetadata(c.Request)
+// topicID returns the topic of the request path, or the general topic for routes without one
+func (ctrl MessageController) topicID(c *gin.Context) (string, bool) {
+	id := c.Param("id")
+	if id == "" {
+		return ctrl.tinode.Topic().ID, true
+	}
+
+	if _, err := models.ParseGroupTopicID(id); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid topic id"})
+		return "", false
+	}
+	return id, true
+}
+
+// Fetch returns a page of the topic history
+func (ctrl MessageController) Fetch(c *gin.Context) {
+	topicID, ok := ctrl.topicID(c)
+	if !ok {
+		return
+	}
+
+	var query forms.HistoryQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		message := msgForm.History(err)
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": message})
+		return
+	}
+
+	page, err := ctrl.tinode.FetchMsgs(c.Request.Context(), getUserID(c), topicID, query)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "User not logged in"})
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// Send publishes a message to the topic on behalf of the user
+func (ctrl MessageController) Send(c *gin.Context) {
+	topicID, ok := ctrl.topicID(c)
+	if !ok {
 		return
 	}
 
-	lastMsg, err := ctrl.tinode.FetchLastMsgs()
+	var textForm forms.TextMessage
+	if err := c.ShouldBind(&textForm); err != nil {
+		message := msgForm.Text(err)
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": message})
+		return
+	}
+
+	err := ctrl.tinode.SendMessage(c.Request.Context(), getAccessUUID(c), topicID, textForm.ReplyTo, textForm.MessageContent())
 	if err != nil {
-		c.JSON(http.StatusNotAcceptable, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, lastMsg)
+	c.JSON(http.StatusOK, gin.H{"message": "Message sent successfully"})
+}
+
+// peerID returns the user the direct messages of the request path are exchanged with
+func (ctrl MessageController) peerID(c *gin.Context) (models.UserID, bool) {
+	peer, err := models.ParseUserID(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+		return "", false
+	}
+	if peer == getUserID(c) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Can not send direct messages to yourself"})
+		return "", false
+	}
+	return peer, true
 }
 
-func (ctrl MessageController) SendMsg(c *gin.Context) {
-	au, err := ctrl.auth.ExtractTokenMetadata(c.Request)
+// FetchDirect returns a page of direct messages exchanged with the user of the request path
+func (ctrl MessageController) FetchDirect(c *gin.Context) {
+	peer, ok := ctrl.peerID(c)
+	if !ok {
+		return
+	}
+
+	var query forms.HistoryQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		message := msgForm.History(err)
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": message})
+		return
+	}
+
+	page, err := ctrl.tinode.FetchDirectMsgs(c.Request.Context(), getUserID(c), peer, query)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "User not logged in"})
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// SendDirect sends a direct message to the user of the request path
+func (ctrl MessageController) SendDirect(c *gin.Context) {
+	peer, ok := ctrl.peerID(c)
+	if !ok {
 		return
 	}
 
@@ -49,11 +132,149 @@ func (ctrl MessageController) SendMsg(c *gin.Context) {
 		return
 	}
 
-	err = ctrl.tinode.SendMessage(au.AccessUUID, textForm.Content)
+	err := ctrl.tinode.SendDirectMessage(c.Request.Context(), getAccessUUID(c), getUserID(c), peer, textForm.ReplyTo, textForm.MessageContent())
 	if err != nil {
-		c.JSON(http.StatusNotAcceptable, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Message sent successfully"})
 }
+
+// seqID returns the message seq ID of the request path
+func seqID(c *gin.Context) (int32, bool) {
+	seq, err := strconv.ParseInt(c.Param("seq"), 10, 32)
+	if err != nil || seq <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid message seq id"})
+		return 0, false
+	}
+	return int32(seq), true
+}
+
+// Edit replaces the text of a message, only its author and moderators may edit it
+func (ctrl MessageController) Edit(c *gin.Context) {
+	topicID, ok := ctrl.topicID(c)
+	if !ok {
+		return
+	}
+	seq, ok := seqID(c)
+	if !ok {
+		return
+	}
+
+	var textForm forms.TextMessage
+	if err := c.ShouldBind(&textForm); err != nil {
+		message := msgForm.Text(err)
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": message})
+		return
+	}
+
+	err := ctrl.tinode.EditMessage(c.Request.Context(), getAccessUUID(c), getUserID(c), topicID, seq, textForm.MessageContent())
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message edited successfully"})
+}
+
+// Delete deletes a message for all users, only its author and moderators may delete it
+func (ctrl MessageController) Delete(c *gin.Context) {
+	topicID, ok := ctrl.topicID(c)
+	if !ok {
+		return
+	}
+	seq, ok := seqID(c)
+	if !ok {
+		return
+	}
+
+	err := ctrl.tinode.DeleteMessage(c.Request.Context(), getAccessUUID(c), getUserID(c), topicID, seq)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Message deleted successfully"})
+}
+
+// React adds a reaction of the user to a message
+func (ctrl MessageController) React(c *gin.Context) {
+	topicID, ok := ctrl.topicID(c)
+	if !ok {
+		return
+	}
+	seq, ok := seqID(c)
+	if !ok {
+		return
+	}
+
+	var reactionForm forms.ReactionForm
+	if err := c.ShouldBind(&reactionForm); err != nil {
+		message := msgForm.Reaction(err)
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": message})
+		return
+	}
+
+	err := ctrl.tinode.React(c.Request.Context(), getAccessUUID(c), getUserID(c), topicID, seq, reactionForm.Emoji, false)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reaction added successfully"})
+}
+
+// Unreact removes a reaction of the user from a message
+func (ctrl MessageController) Unreact(c *gin.Context) {
+	topicID, ok := ctrl.topicID(c)
+	if !ok {
+		return
+	}
+	seq, ok := seqID(c)
+	if !ok {
+		return
+	}
+
+	var reactionForm forms.ReactionForm
+	if err := c.ShouldBindUri(&reactionForm); err != nil {
+		message := msgForm.Reaction(err)
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": message})
+		return
+	}
+
+	err := ctrl.tinode.React(c.Request.Context(), getAccessUUID(c), getUserID(c), topicID, seq, reactionForm.Emoji, true)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reaction removed successfully"})
+}
+
+// Thread returns a message with a page of replies to it
+func (ctrl MessageController) Thread(c *gin.Context) {
+	topicID, ok := ctrl.topicID(c)
+	if !ok {
+		return
+	}
+	seq, ok := seqID(c)
+	if !ok {
+		return
+	}
+
+	var query forms.HistoryQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		message := msgForm.History(err)
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": message})
+		return
+	}
+
+	thread, err := ctrl.tinode.FetchThread(c.Request.Context(), getUserID(c), topicID, seq, query)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, thread)
+}
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// PasswordController handles account recovery and password changes
+type PasswordController struct {
+	password *service.PasswordService
+}
+
+func NewPasswordController(password *service.PasswordService) *PasswordController {
+	return &PasswordController{password: password}
+}
+
+// Forgot mails a password reset token, the response is the same whether the email is registered or not
+func (ctrl PasswordController) Forgot(c *gin.Context) {
+	var forgotForm forms.ForgotPasswordForm
+	if err := c.ShouldBindJSON(&forgotForm); err != nil {
+		message := userForm.ForgotPassword(err)
+		c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"message": message})
+		return
+	}
+
+	if err := ctrl.password.Forgot(c.Request.Context(), forgotForm.Email); err != nil {
+		c.AbortWithStatusJSON(errorStatus(err, http.StatusInternalServerError), gin.H{"message": "Failed to send the password reset email, please try again later"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the email is registered, a password reset code has been sent"})
+}
+
+// Reset sets a new password with the token mailed to the user, all sessions of the user are logged out
+func (ctrl PasswordController) Reset(c *gin.Context) {
+	var resetForm forms.ResetPasswordForm
+	if err := c.ShouldBindJSON(&resetForm); err != nil {
+		message := userForm.ResetPassword(err)
+		c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"message": message})
+		return
+	}
+
+	if err := ctrl.password.Reset(c.Request.Context(), resetForm.Token, resetForm.Password); err != nil {
+		if errors.Is(err, service.ErrInvalidToken) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid or expired reset code"})
+			return
+		}
+		c.AbortWithStatusJSON(errorStatus(err, http.StatusInternalServerError), gin.H{"message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully, please log in again"})
+}
+
+// Change replaces the password of the logged-in user, all sessions of the user are logged out, including the current one
+func (ctrl PasswordController) Change(c *gin.Context) {
+	var changeForm forms.ChangePasswordForm
+	if err := c.ShouldBindJSON(&changeForm); err != nil {
+		message := userForm.ChangePassword(err)
+		c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"message": message})
+		return
+	}
+
+	err := ctrl.password.Change(c.Request.Context(), getAccessUUID(c), getUserID(c), changeForm.OldPassword, changeForm.NewPassword)
+	if errors.Is(err, service.ErrWrongPassword) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Your current password is wrong"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(errorStatus(err, http.StatusInternalServerError), gin.H{"message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully, please log in again"})
+}
@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"github.com/dartt0n/realtime-chat-backend/service"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait    = 10 * time.Second    // time allowed to write a frame to the client
+	wsPongWait     = 60 * time.Second    // time allowed to read the next pong from the client
+	wsPingPeriod   = wsPongWait * 9 / 10 // must be less than wsPongWait
+	wsMaxFrameSize = 8192                // maximum frame size accepted from the client
+
+	sseKeepAlive   = 30 * time.Second // interval between keep-alive comments, so proxies don't drop idle streams
+	sseReplayLimit = 1000             // maximum number of missed messages replayed on reconnect, a gap event is sent beyond it
+)
+
+// RealtimeController pushes Tinode updates to clients over long-lived connections
+type RealtimeController struct {
+	auth     *service.AuthService
+	tinode   *service.TinodeService
+	upgrader websocket.Upgrader
+}
+
+var realtimeForm = new(forms.RealtimeForm)
+
+// NewRealtimeController creates and returns a new RealtimeController instance
+// allowedOrigin: origin allowed to open WebSocket connections besides same-origin requests
+func NewRealtimeController(tinode *service.TinodeService, auth *service.AuthService, allowedOrigin string) *RealtimeController {
+	return &RealtimeController{
+		auth:   auth,
+		tinode: tinode,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin: func(r *http.Request) bool {
+				origin := r.Header.Get("Origin")
+				return origin == "" || origin == allowedOrigin || origin == "http://"+r.Host || origin == "https://"+r.Host
+			},
+		},
+	}
+}
+
+// WebSocket upgrades the connection and streams data, presence and info events
+// of the user's topics as JSON frames. Clients may publish messages by sending
+// {"type": "pub", "content": "..."} frames over the same connection.
+func (ctrl RealtimeController) WebSocket(c *gin.Context) {
+	accessUUID := getAccessUUID(c)
+
+	sub, err := ctrl.tinode.Subscribe(c.Request.Context(), accessUUID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	defer sub.Close()
+
+	conn, err := ctrl.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// upgrader has already replied with an HTTP error
+		slog.Error("failed to upgrade connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	replies := make(chan gin.H, 8)
+	done := make(chan struct{})
+	defer close(done)
+	reply := func(msg gin.H) {
+		select {
+		case replies <- msg:
+		case <-done:
+		}
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		ctrl.readFrames(c.Request.Context(), conn, getUserID(c), accessUUID, reply)
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	// all writes happen on this goroutine, gorilla/websocket allows only one concurrent writer
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := writeFrame(conn, ev); err != nil {
+				slog.Error("failed to write event", "error", err, "access_uuid", accessUUID)
+				return
+			}
+		case reply := <-replies:
+			if err := writeFrame(conn, reply); err != nil {
+				slog.Error("failed to write reply", "error", err, "access_uuid", accessUUID)
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				slog.Debug("failed to ping client", "error", err, "access_uuid", accessUUID)
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// readFrames reads client frames until the connection is closed and executes them
+func (ctrl RealtimeController) readFrames(ctx context.Context, conn *websocket.Conn, userID models.UserID, accessUUID string, reply func(gin.H)) {
+	conn.SetReadLimit(wsMaxFrameSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				slog.Error("websocket closed unexpectedly", "error", err, "access_uuid", accessUUID)
+			}
+			return
+		}
+
+		var frame forms.ClientFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			reply(gin.H{"type": "ctrl", "code": http.StatusBadRequest, "error": "Invalid frame"})
+			continue
+		}
+		if err := binding.Validator.ValidateStruct(&frame); err != nil {
+			reply(gin.H{"type": "ctrl", "id": frame.ID, "code": http.StatusNotAcceptable, "error": realtimeForm.Frame(err)})
+			continue
+		}
+
+		// frames address group topics by their ID and direct messages by the ID of the peer
+		topicID := ctrl.tinode.Topic().ID
+		var peer models.UserID
+		if frame.Topic != "" {
+			if _, err := models.ParseGroupTopicID(frame.Topic); err == nil {
+				topicID = frame.Topic
+			} else if peer, err = models.ParseUserID(frame.Topic); err != nil || peer == userID {
+				reply(gin.H{"type": "ctrl", "id": frame.ID, "code": http.StatusBadRequest, "error": "Invalid topic id"})
+				continue
+			}
+		}
+
+		switch frame.Type {
+		case "pub":
+			var err error
+			if peer != "" {
+				err = ctrl.tinode.SendDirectMessage(ctx, accessUUID, userID, peer, frame.ReplyTo, frame.MessageContent())
+			} else {
+				err = ctrl.tinode.SendMessage(ctx, accessUUID, topicID, frame.ReplyTo, frame.MessageContent())
+			}
+			if err != nil {
+				reply(gin.H{"type": "ctrl", "id": frame.ID, "code": errorStatus(err, http.StatusNotAcceptable), "error": err.Error()})
+				continue
+			}
+			reply(gin.H{"type": "ctrl", "id": frame.ID, "code": http.StatusOK, "message": "Message sent successfully"})
+		case "kp":
+			target := topicID
+			if peer != "" {
+				target = string(peer)
+			}
+			if err := ctrl.tinode.Typing(ctx, accessUUID, target); err != nil {
+				reply(gin.H{"type": "ctrl", "id": frame.ID, "code": errorStatus(err, http.StatusNotAcceptable), "error": err.Error()})
+			}
+		}
+	}
+}
+
+// writeFrame writes a single JSON frame to the client
+func writeFrame(conn *websocket.Conn, v any) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteJSON(v)
+}
+
+// Events streams the same events as WebSocket using Server-Sent Events.
+// Data events of the general topic carry their Tinode seq ID as the event ID, so a reconnecting client
+// sending Last-Event-ID (or last_event_id query parameter) receives the messages it
+// missed before switching to live events. If too many messages were missed, a gap event is sent
+// instead and the client is expected to refetch the history from /messages.
+func (ctrl RealtimeController) Events(c *gin.Context) {
+	accessUUID := getAccessUUID(c)
+	topic := ctrl.tinode.Topic().ID
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+
+	// subscribe before replaying history, so no message falls between the two
+	sub, err := ctrl.tinode.Subscribe(c.Request.Context(), accessUUID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	defer sub.Close()
+
+	var missed []models.Message
+	var lastSeq int32
+	var gap bool
+	if lastEventID != "" {
+		seq, parseErr := strconv.ParseInt(lastEventID, 10, 32)
+		if parseErr != nil || seq < 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid Last-Event-ID"})
+			return
+		}
+		lastSeq = int32(seq)
+
+		missed, gap, err = ctrl.tinode.FetchMsgsSince(c.Request.Context(), getUserID(c), lastSeq, sseReplayLimit)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	if gap {
+		// a partial replay would leave a hole in the client's history
+		renderEvent(c, topic, models.Event{Type: models.EventGap, Topic: topic})
+	} else {
+		for _, m := range missed {
+			renderEvent(c, topic, service.MessageEvent(topic, m))
+			lastSeq = m.SeqID
+		}
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				return false
+			}
+			// skip live messages that were already replayed from history
+			if ev.Type == models.EventData && ev.Topic == topic && ev.SeqID <= lastSeq {
+				return true
+			}
+			renderEvent(c, topic, ev)
+			return true
+		case <-ticker.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			slog.Debug("event stream closed by client", "access_uuid", accessUUID)
+			return false
+		}
+	})
+}
+
+// renderEvent writes a single Server-Sent Event, using seq ID as event ID for data events of the replayed topic.
+// Seq IDs are counted per topic, so events of other topics carry no ID and leave Last-Event-ID intact.
+func renderEvent(c *gin.Context, topic string, ev models.Event) {
+	msg := sse.Event{Event: ev.Type, Data: ev}
+	if ev.Type == models.EventData && ev.Topic == topic {
+		msg.Id = strconv.FormatInt(int64(ev.SeqID), 10)
+	}
+	c.Render(-1, msg)
+}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// ScheduleController handles messages scheduled to be published later
+type ScheduleController struct {
+	schedule *service.ScheduleService
+	tinode   *service.TinodeService
+}
+
+func NewScheduleController(schedule *service.ScheduleService, tinode *service.TinodeService) *ScheduleController {
+	return &ScheduleController{schedule: schedule, tinode: tinode}
+}
+
+// Create schedules a message to the topic of the form, the general topic by default
+func (ctrl ScheduleController) Create(c *gin.Context) {
+	var scheduleForm forms.ScheduledMessage
+	if err := c.ShouldBindJSON(&scheduleForm); err != nil {
+		message := msgForm.Schedule(err)
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": message})
+		return
+	}
+
+	topic := scheduleForm.Topic
+	if topic == "" {
+		topic = ctrl.tinode.Topic().ID
+	}
+	topicID, ok := storedTopicID(c, topic)
+	if !ok {
+		return
+	}
+
+	job, err := ctrl.schedule.Schedule(c.Request.Context(), getUserID(c), topic, topicID, scheduleForm)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// List returns the messages the user has scheduled
+func (ctrl ScheduleController) List(c *gin.Context) {
+	jobs, err := ctrl.schedule.List(c.Request.Context(), getUserID(c))
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"scheduled": jobs})
+}
+
+// Cancel deletes a scheduled message of the user before it is published
+func (ctrl ScheduleController) Cancel(c *gin.Context) {
+	if err := ctrl.schedule.Cancel(c.Request.Context(), getUserID(c), c.Param("id")); err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Scheduled message canceled"})
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"github.com/dartt0n/realtime-chat-backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// SearchController handles full-text search of messages
+type SearchController struct {
+	tinode *service.TinodeService
+}
+
+var searchForm = new(forms.SearchForm)
+
+func NewSearchController(tinode *service.TinodeService) *SearchController {
+	return &SearchController{tinode: tinode}
+}
+
+// Search returns a page of messages matching the query in the topics the user may read
+func (ctrl SearchController) Search(c *gin.Context) {
+	var query forms.SearchQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		message := searchForm.Search(err)
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": message})
+		return
+	}
+
+	var topicID string
+	if query.Topic != "" {
+		var ok bool
+		if topicID, ok = storedTopicID(c, query.Topic); !ok {
+			return
+		}
+	}
+
+	var author models.UserID
+	if query.From != "" {
+		var err error
+		if author, err = models.ParseUserID(query.From); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+			return
+		}
+	}
+
+	page, err := ctrl.tinode.Search(c.Request.Context(), getUserID(c), topicID, author, query)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
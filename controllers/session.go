@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/dartt0n/realtime-chat-backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// SessionController handles the listing and revocation of the user's sessions
+type SessionController struct {
+	auth *service.AuthService
+}
+
+func NewSessionController(auth *service.AuthService) *SessionController {
+	return &SessionController{auth: auth}
+}
+
+// List returns the active sessions of the user, the one of the request is marked as current
+func (ctrl SessionController) List(c *gin.Context) {
+	sessions, err := ctrl.auth.Sessions(getUserID(c), getSessionID(c))
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// Revoke logs the user out of the session of the request path, which may be the current one
+func (ctrl SessionController) Revoke(c *gin.Context) {
+	if err := ctrl.auth.RevokeSession(getUserID(c), c.Param("id")); err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// RevokeAll logs the user out everywhere, including the current session
+func (ctrl SessionController) RevokeAll(c *gin.Context) {
+	if err := ctrl.auth.RevokeSessions(getUserID(c)); err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions"})
+}
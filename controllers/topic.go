@@ -0,0 +1,240 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"github.com/dartt0n/realtime-chat-backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// TopicController handles topic management requests
+type TopicController struct {
+	tinode *service.TinodeService
+}
+
+var topicForm = new(forms.TopicForm)
+
+func NewTopicController(tinode *service.TinodeService) *TopicController {
+	return &TopicController{tinode: tinode}
+}
+
+// Create creates a new group topic owned by the user
+func (ctrl TopicController) Create(c *gin.Context) {
+	var createForm forms.CreateTopicForm
+	if err := c.ShouldBindJSON(&createForm); err != nil {
+		message := topicForm.Create(err)
+		c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"message": message})
+		return
+	}
+
+	topic, err := ctrl.tinode.CreateTopic(c.Request.Context(), getAccessUUID(c), getUserID(c), createForm)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, topic)
+}
+
+// List returns the group topics the user is subscribed to
+func (ctrl TopicController) List(c *gin.Context) {
+	topics, err := ctrl.tinode.ListTopics(c.Request.Context(), getAccessUUID(c))
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"topics": topics})
+}
+
+// Join subscribes the user to the topic
+func (ctrl TopicController) Join(c *gin.Context) {
+	topicID, err := models.ParseGroupTopicID(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid topic id"})
+		return
+	}
+
+	if err := ctrl.tinode.JoinTopic(c.Request.Context(), getAccessUUID(c), topicID); err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Joined topic successfully"})
+}
+
+// Leave unsubscribes the user from the topic
+func (ctrl TopicController) Leave(c *gin.Context) {
+	topicID, err := models.ParseGroupTopicID(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid topic id"})
+		return
+	}
+
+	// every session is joined to the general topic on login, leaving it would not last
+	if topicID == ctrl.tinode.Topic().ID {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "The general topic can not be left"})
+		return
+	}
+
+	if err := ctrl.tinode.LeaveTopic(c.Request.Context(), getAccessUUID(c), topicID); err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Left topic successfully"})
+}
+
+// noteTopicID returns the topic of the request path notes are sent to,
+// either a group topic or the ID of a user for the direct messages with that user
+func noteTopicID(c *gin.Context) (string, bool) {
+	topicID := c.Param("id")
+	if _, err := models.ParseGroupTopicID(topicID); err != nil {
+		if _, err := models.ParseUserID(topicID); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid topic id"})
+			return "", false
+		}
+	}
+	return topicID, true
+}
+
+// storedTopicID returns the ID the topic is stored under: a group topic ID as is,
+// or the peer-to-peer topic of the user with the given user
+func storedTopicID(c *gin.Context, topic string) (string, bool) {
+	if _, err := models.ParseGroupTopicID(topic); err == nil {
+		return topic, true
+	}
+	if peer, err := models.ParseUserID(topic); err == nil {
+		if topicID, err := models.P2PTopicID(getUserID(c), peer); err == nil {
+			return topicID, true
+		}
+	}
+
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid topic id"})
+	return "", false
+}
+
+// receipt reports the read or receive state of the topic (or of direct messages with a user) for the user
+func (ctrl TopicController) receipt(c *gin.Context, mark func(ctx context.Context, accessUUID, topicID string, seq int32) error) {
+	topicID, ok := noteTopicID(c)
+	if !ok {
+		return
+	}
+
+	var receiptForm forms.ReceiptForm
+	if err := c.ShouldBindJSON(&receiptForm); err != nil {
+		message := topicForm.Receipt(err)
+		c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"message": message})
+		return
+	}
+
+	if err := mark(c.Request.Context(), getAccessUUID(c), topicID, receiptForm.SeqID); err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Receipt sent successfully"})
+}
+
+// Read marks the messages of the topic up to the given seq ID as read
+func (ctrl TopicController) Read(c *gin.Context) {
+	ctrl.receipt(c, ctrl.tinode.MarkRead)
+}
+
+// Recv marks the messages of the topic up to the given seq ID as received
+func (ctrl TopicController) Recv(c *gin.Context) {
+	ctrl.receipt(c, ctrl.tinode.MarkRecv)
+}
+
+// Unread returns the number of unread messages per topic
+func (ctrl TopicController) Unread(c *gin.Context) {
+	unread, err := ctrl.tinode.UnreadCounts(c.Request.Context(), getAccessUUID(c))
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"unread": unread})
+}
+
+// Typing notifies other subscribers of the topic that the user is typing
+func (ctrl TopicController) Typing(c *gin.Context) {
+	topicID, ok := noteTopicID(c)
+	if !ok {
+		return
+	}
+
+	if err := ctrl.tinode.Typing(c.Request.Context(), getAccessUUID(c), topicID); err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Online returns the users currently online in the topic
+func (ctrl TopicController) Online(c *gin.Context) {
+	topicID, err := models.ParseGroupTopicID(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid topic id"})
+		return
+	}
+
+	users, err := ctrl.tinode.OnlineUsers(c.Request.Context(), getAccessUUID(c), getUserID(c), topicID)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"online": users})
+}
+
+// changePin pins or unpins the message of the request path, only moderators of the topic may do so
+func (ctrl TopicController) changePin(c *gin.Context, change func(ctx context.Context, accessUUID string, userID models.UserID, topicID string, seq int32) error, done string) {
+	topicID, err := models.ParseGroupTopicID(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid topic id"})
+		return
+	}
+	seq, ok := seqID(c)
+	if !ok {
+		return
+	}
+
+	if err := change(c.Request.Context(), getAccessUUID(c), getUserID(c), topicID, seq); err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": done})
+}
+
+// Pin pins a message in the topic
+func (ctrl TopicController) Pin(c *gin.Context) {
+	ctrl.changePin(c, ctrl.tinode.PinMessage, "Message pinned successfully")
+}
+
+// Unpin unpins a message in the topic
+func (ctrl TopicController) Unpin(c *gin.Context) {
+	ctrl.changePin(c, ctrl.tinode.UnpinMessage, "Message unpinned successfully")
+}
+
+// Pins returns the messages pinned in the topic, the latest pin first
+func (ctrl TopicController) Pins(c *gin.Context) {
+	topicID, err := models.ParseGroupTopicID(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid topic id"})
+		return
+	}
+
+	pins, err := ctrl.tinode.PinnedMessages(c.Request.Context(), getUserID(c), topicID)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pins": pins})
+}
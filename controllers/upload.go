@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"bufio"
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/dartt0n/realtime-chat-backend/blob"
+	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// multipartOverhead is the room left for multipart headers and form fields above the file size limit
+const multipartOverhead = 64 << 10
+
+// UploadController handles uploads and downloads of message attachments
+type UploadController struct {
+	uploads *service.UploadService
+	tinode  *service.TinodeService
+	maxSize int64
+}
+
+var uploadForm = new(forms.UploadForm)
+
+// NewUploadController creates an UploadController accepting files of up to maxSize bytes
+func NewUploadController(uploads *service.UploadService, tinode *service.TinodeService, maxSize int64) *UploadController {
+	return &UploadController{uploads: uploads, tinode: tinode, maxSize: maxSize}
+}
+
+// Upload stores a file attached to messages and returns the reference to it
+func (ctrl UploadController) Upload(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, ctrl.maxSize+multipartOverhead)
+
+	var fileForm forms.FileUpload
+	if err := c.ShouldBind(&fileForm); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+			return
+		}
+		message := uploadForm.Upload(err)
+		c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"error": message})
+		return
+	}
+	if fileForm.File.Size > ctrl.maxSize {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+		return
+	}
+
+	// files are uploaded to the general topic unless another one is given
+	topicID := ctrl.tinode.Topic().ID
+	if fileForm.Topic != "" {
+		var ok bool
+		if topicID, ok = storedTopicID(c, fileForm.Topic); !ok {
+			return
+		}
+	}
+
+	file, err := fileForm.File.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read the file"})
+		return
+	}
+	defer file.Close()
+
+	// the type declared by the client is trusted unless it is missing or generic
+	r := bufio.NewReader(file)
+	mimeType := fileForm.File.Header.Get("Content-Type")
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		head, _ := r.Peek(512)
+		mimeType = http.DetectContentType(head)
+	}
+
+	info := blob.Info{Name: fileForm.File.Filename, MIME: mimeType, Size: fileForm.File.Size}
+	attachment, err := ctrl.uploads.Upload(c.Request.Context(), getUserID(c), topicID, r, info)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// Download streams a file attached to messages of the topic, only the topic's readers may download it
+func (ctrl UploadController) Download(c *gin.Context) {
+	topicID := c.Param("topic")
+
+	file, info, err := ctrl.uploads.Download(c.Request.Context(), getUserID(c), topicID, c.Param("id"))
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"error": err.Error()})
+		return
+	}
+	defer file.Close()
+
+	// files are always downloaded, never rendered, so uploaded HTML can not run on the backend's origin
+	c.DataFromReader(http.StatusOK, info.Size, info.MIME, file, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType("attachment", map[string]string{"filename": info.Name}),
+		"X-Content-Type-Options": "nosniff",
+	})
+}
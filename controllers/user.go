@@ -1,7 +1,11 @@
 package controllers
 
 import (
+	"errors"
+	"log/slog"
+
 	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/models"
 	"github.com/dartt0n/realtime-chat-backend/service"
 
 	"net/http"
@@ -11,21 +15,32 @@ import (
 
 // UserController handles user-related HTTP requests and responses
 type UserController struct {
-	user *service.TinodeService
-	auth *service.AuthService
+	user   *service.TinodeService
+	auth   *service.AuthService
+	verify *service.VerifyService
 }
 
 // NewUserController creates and returns a new UserController instance
-func NewUserController(user *service.TinodeService, auth *service.AuthService) *UserController {
-	return &UserController{user: user, auth: auth}
+func NewUserController(user *service.TinodeService, auth *service.AuthService, verify *service.VerifyService) *UserController {
+	return &UserController{user: user, auth: auth, verify: verify}
 }
 
 var userForm = new(forms.UserForm)
 
 // getUserID extracts and returns the user ID from the Gin context
-func getUserID(c *gin.Context) (userID int64) {
+func getUserID(c *gin.Context) (userID models.UserID) {
 	//MustGet returns the value for the given key if it exists, otherwise it panics.
-	return c.MustGet("userID").(int64)
+	return c.MustGet("userID").(models.UserID)
+}
+
+// getAccessUUID extracts and returns the access token UUID from the Gin context
+func getAccessUUID(c *gin.Context) string {
+	return c.MustGet("accessUUID").(string)
+}
+
+// getSessionID extracts and returns the session (token family) ID from the Gin context
+func getSessionID(c *gin.Context) string {
+	return c.MustGet("sessionID").(string)
 }
 
 // Login handles user authentication requests, validates credentials and returns a JWT token
@@ -38,7 +53,12 @@ func (ctrl UserController) Login(c *gin.Context) {
 		return
 	}
 
-	_, token, err := ctrl.user.Login(loginForm)
+	client := models.ClientInfo{UserAgent: c.Request.UserAgent(), IP: c.ClientIP()}
+	_, token, err := ctrl.user.Login(c.Request.Context(), loginForm, client)
+	if errors.Is(err, service.ErrEmailNotVerified) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Please verify your email first"})
+		return
+	}
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"message": "Invalid login details"})
 		return
@@ -57,13 +77,19 @@ func (ctrl UserController) Register(c *gin.Context) {
 		return
 	}
 
-	_, err := ctrl.user.CreateUser(registerForm)
+	user, err := ctrl.user.CreateUser(c.Request.Context(), registerForm)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"message": err.Error()})
+		c.AbortWithStatusJSON(errorStatus(err, http.StatusNotAcceptable), gin.H{"message": err.Error()})
+		return
+	}
+
+	if err := ctrl.verify.Start(c.Request.Context(), user); err != nil {
+		slog.Error("failed to send verification email", "error", err, "user_id", user.ID)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "User registered, but the verification email could not be sent, please request a new one"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "User registered successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "User registered successfully, please check your email to verify it"})
 }
 
 // Logout handles user logout requests by invalidating the JWT token
@@ -75,8 +101,9 @@ func (ctrl UserController) Logout(c *gin.Context) {
 		return
 	}
 
-	_, delErr := ctrl.auth.DeleteAuth(au.AccessUUID)
-	if delErr != nil { // if any goes wrong
+	// the whole session ends: access and refresh tokens, the Tinode token and the Tinode session
+	revokeErr := ctrl.auth.RevokeFamily(au.FamilyID)
+	if revokeErr != nil { // if any goes wrong
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid request"})
 		return
 	}
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/service"
+	"github.com/gin-gonic/gin"
+)
+
+// VerifyController handles email verification
+type VerifyController struct {
+	verify *service.VerifyService
+}
+
+func NewVerifyController(verify *service.VerifyService) *VerifyController {
+	return &VerifyController{verify: verify}
+}
+
+// Verify confirms the email with the token mailed to it, the user can log in afterwards
+func (ctrl VerifyController) Verify(c *gin.Context) {
+	var verifyForm forms.VerifyForm
+	if err := c.ShouldBindJSON(&verifyForm); err != nil {
+		message := userForm.Verify(err)
+		c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"message": message})
+		return
+	}
+
+	if _, err := ctrl.verify.Verify(verifyForm.Token); err != nil {
+		if errors.Is(err, service.ErrInvalidToken) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid or expired verification code"})
+			return
+		}
+		c.AbortWithStatusJSON(errorStatus(err, http.StatusInternalServerError), gin.H{"message": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+// Resend mails a new verification token, the response is the same whether the email is registered or not
+func (ctrl VerifyController) Resend(c *gin.Context) {
+	var resendForm forms.ResendForm
+	if err := c.ShouldBindJSON(&resendForm); err != nil {
+		message := userForm.Resend(err)
+		c.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"message": message})
+		return
+	}
+
+	if err := ctrl.verify.Resend(c.Request.Context(), resendForm.Email); err != nil {
+		c.AbortWithStatusJSON(errorStatus(err, http.StatusInternalServerError), gin.H{"message": "Failed to send the verification email, please try again later"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the email awaits verification, a new code has been sent"})
+}
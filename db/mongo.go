@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+)
+
+// MongoConfig holds the connection pool settings of the MongoDB client
+type MongoConfig struct {
+	URI             string
+	MaxPoolSize     uint64
+	MinPoolSize     uint64
+	ConnectTimeout  time.Duration // Timeout of establishing a single connection
+	Timeout         time.Duration // Default timeout of every operation, applied if the context has no deadline
+	HistoryReadPref string        // Read preference of the readonly history path, e.g. "secondaryPreferred"
+}
+
+// DefaultMongoConfig returns the configuration used for settings that are not provided
+func DefaultMongoConfig(uri string) MongoConfig {
+	return MongoConfig{
+		URI:             uri,
+		MaxPoolSize:     100,
+		MinPoolSize:     0,
+		ConnectTimeout:  10 * time.Second,
+		Timeout:         10 * time.Second,
+		HistoryReadPref: "secondaryPreferred",
+	}
+}
+
+// Mongo is a long-lived, pooled MongoDB client shared by all requests
+type Mongo struct {
+	client      *mongo.Client
+	historyPref *readpref.ReadPref
+}
+
+// NewMongo connects to MongoDB with the given configuration.
+// Returns an error if the configuration is invalid or the primary cannot be reached.
+func NewMongo(ctx context.Context, cfg MongoConfig) (*Mongo, error) {
+	mode, err := readpref.ModeFromString(cfg.HistoryReadPref)
+	if err != nil {
+		return nil, err
+	}
+	historyPref, err := readpref.New(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := mongo.Connect(options.Client().
+		ApplyURI(cfg.URI).
+		SetMaxPoolSize(cfg.MaxPoolSize).
+		SetMinPoolSize(cfg.MinPoolSize).
+		SetConnectTimeout(cfg.ConnectTimeout).
+		SetServerSelectionTimeout(cfg.ConnectTimeout).
+		SetTimeout(cfg.Timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	return &Mongo{client: client, historyPref: historyPref}, nil
+}
+
+// Database returns a handle of the database reading from the primary
+func (m *Mongo) Database(name string) *mongo.Database {
+	return m.client.Database(name)
+}
+
+// History returns a handle of the database for the readonly history path,
+// reads go through the configured history read preference (secondaries by default)
+func (m *Mongo) History(name string) *mongo.Database {
+	return m.client.Database(name, options.Database().SetReadPreference(m.historyPref))
+}
+
+// Close waits for in-use connections to be returned to the pool and closes all of them
+func (m *Mongo) Close(ctx context.Context) error {
+	return m.client.Disconnect(ctx)
+}
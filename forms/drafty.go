@@ -0,0 +1,91 @@
+package forms
+
+import (
+	"unicode/utf8"
+
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"github.com/go-playground/validator/v10"
+)
+
+// MessageBody contains the content of a message: Content is converted from Markdown
+// unless Format is "plain", a Drafty document may be sent instead (JSON only)
+type MessageBody struct {
+	Content string          `form:"content" json:"content" binding:"max=4096"`
+	Format  string          `form:"format" json:"format" binding:"omitempty,oneof=plain markdown"`
+	Drafty  *DraftyDocument `form:"-" json:"drafty" binding:"omitempty"`
+}
+
+// DraftyDocument is a Tinode Drafty document, see models.Drafty
+// Positions are counted in runes, styles with a negative position are attachments shown after the text
+type DraftyDocument struct {
+	Txt string         `json:"txt" binding:"max=4096"`
+	Fmt []DraftyStyle  `json:"fmt" binding:"max=1024,dive"`
+	Ent []DraftyEntity `json:"ent" binding:"max=64,dive"`
+}
+
+// DraftyStyle styles a part of the text inline (Tp) or with an entity (Key)
+type DraftyStyle struct {
+	At  int    `json:"at" binding:"min=-1"`
+	Len int    `json:"len" binding:"min=0"`
+	Tp  string `json:"tp" binding:"omitempty,oneof=ST EM DL CO HL RW BR HD"`
+	Key int    `json:"key" binding:"min=0"`
+}
+
+// DraftyEntity is a link (LN), mention (MN), hashtag (HT), image (IM) or file attachment (EX)
+type DraftyEntity struct {
+	Tp   string         `json:"tp" binding:"required,oneof=LN MN HT IM EX"`
+	Data map[string]any `json:"data"`
+}
+
+// MessageContent returns the content to publish
+func (b MessageBody) MessageContent() models.Content {
+	switch {
+	case b.Drafty != nil:
+		d := &models.Drafty{Txt: b.Drafty.Txt}
+		for _, st := range b.Drafty.Fmt {
+			d.Fmt = append(d.Fmt, models.DraftyStyle(st))
+		}
+		for _, ent := range b.Drafty.Ent {
+			d.Ent = append(d.Ent, models.DraftyEntity(ent))
+		}
+		return models.Content{Drafty: d}
+	case b.Format == "plain":
+		return models.Content{Text: b.Content}
+	default:
+		return models.ParseMarkdown(b.Content)
+	}
+}
+
+// hasContent reports whether the body has either text or a Drafty document
+func (b MessageBody) hasContent() bool {
+	return b.Content != "" || b.Drafty != nil
+}
+
+// validateDrafty checks that the styles of a Drafty document are within its text and refer to existing entities,
+// and that links and attachments have safe URLs
+func validateDrafty(sl validator.StructLevel) {
+	d := sl.Current().Interface().(DraftyDocument)
+	n := utf8.RuneCountInString(d.Txt)
+
+	for _, st := range d.Fmt {
+		if st.At+st.Len > n || (st.At < 0 && st.Len != 0) || (st.Tp == "" && st.Key >= len(d.Ent)) {
+			sl.ReportError(d.Fmt, "Fmt", "Fmt", "drafty", "")
+			return
+		}
+	}
+
+	for _, ent := range d.Ent {
+		key := "url"
+		switch ent.Tp {
+		case "IM", "EX":
+			// inline attachments are not accepted, files must be uploaded first
+			key = "ref"
+		case "MN", "HT":
+			continue
+		}
+		if u, _ := ent.Data[key].(string); !models.SafeURL(u) {
+			sl.ReportError(d.Ent, "Ent", "Ent", "drafty", "")
+			return
+		}
+	}
+}
@@ -9,16 +9,31 @@ import (
 // MessageForm represents the base form structure for message-related forms
 type MessageForm struct{}
 
-// TextMessage represents a text message with content
-// Content must be between 1 and 4096 characters
+// TextMessage represents a message with Markdown, plain text or Drafty content
+// Content can be up to 4096 characters and is required unless a Drafty document is given
+// ReplyTo is the seq ID of the message replied to, ignored by edits
 type TextMessage struct {
-	Content string `form:"content" json:"content" binding:"required,min=1,max=4096"`
+	MessageBody
+	ReplyTo int32 `form:"reply_to" json:"reply_to" binding:"omitempty,min=1"`
+}
+
+// ReactionForm contains the emoji of a reaction to a message, an emoji of up to 32 bytes
+type ReactionForm struct {
+	Emoji string `form:"emoji" json:"emoji" uri:"emoji" binding:"required,max=32,emoji"`
+}
+
+// HistoryQuery represents the query of a message history page
+// Before and After are exclusive seq ID bounds, Limit must be between 1 and 100 (50 by default)
+type HistoryQuery struct {
+	Before int32 `form:"before" binding:"omitempty,min=1"`
+	After  int32 `form:"after" binding:"omitempty,min=1"`
+	Limit  int64 `form:"limit" binding:"omitempty,min=1,max=100"`
 }
 
 // Content returns the appropriate error message for content validation tags
 func (f MessageForm) Content(tag string, errMsg ...string) string {
 	switch tag {
-	case "required":
+	case "required", "required_if":
 		return "Please provide message content"
 	case "min", "max":
 		return "Message content can be from 1 to 4096 characters"
@@ -27,7 +42,23 @@ func (f MessageForm) Content(tag string, errMsg ...string) string {
 	}
 }
 
-// Text validates a TextMessagew and returns appropriate error messages
+// Body returns the appropriate error message for validation errors of MessageBody fields
+func (f MessageForm) Body(field, tag string) (string, bool) {
+	switch field {
+	case "Content":
+		return f.Content(tag), true
+	case "Format":
+		return "Message format can be plain or markdown", true
+	case "ReplyTo":
+		return "Please provide a valid message seq id to reply to", true
+	case "Drafty", "Txt", "Fmt", "Ent", "At", "Len", "Tp", "Key":
+		return "Invalid Drafty document", true
+	default:
+		return "", false
+	}
+}
+
+// Text validates a TextMessage and returns appropriate error messages
 func (f MessageForm) Text(err error) string {
 	switch err.(type) {
 	case validator.ValidationErrors:
@@ -36,8 +67,44 @@ func (f MessageForm) Text(err error) string {
 		}
 
 		for _, err := range err.(validator.ValidationErrors) {
-			if err.Field() == "Content" {
-				return f.Content(err.Tag())
+			if message, ok := f.Body(err.Field(), err.Tag()); ok {
+				return message
+			}
+		}
+	default:
+		return "Invalid request"
+	}
+	return "Something went wrong, please try again later"
+}
+
+// History validates a HistoryQuery and returns appropriate error messages
+func (f MessageForm) History(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		for _, err := range err.(validator.ValidationErrors) {
+			switch err.Field() {
+			case "Before", "After":
+				return "Cursor must be a positive message seq id"
+			case "Limit":
+				return "Limit can be from 1 to 100"
+			}
+		}
+	default:
+		return "Invalid query"
+	}
+	return "Something went wrong, please try again later"
+}
+
+// Reaction validates a ReactionForm and returns appropriate error messages
+func (f MessageForm) Reaction(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		for _, err := range err.(validator.ValidationErrors) {
+			if err.Field() == "Emoji" {
+				if err.Tag() == "required" {
+					return "Please provide an emoji"
+				}
+				return "Reaction must be an emoji"
 			}
 		}
 	default:
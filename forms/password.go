@@ -0,0 +1,76 @@
+package forms
+
+import (
+	"github.com/go-playground/validator/v10"
+)
+
+// ForgotPasswordForm contains the email a password reset token is mailed to
+type ForgotPasswordForm struct {
+	Email string `form:"email" json:"email" binding:"required,email"`
+}
+
+// ResetPasswordForm contains the token mailed to the user and the new password
+type ResetPasswordForm struct {
+	Token    string `form:"token" json:"token" binding:"required,max=128"`
+	Password string `form:"password" json:"password" binding:"required,min=3,max=50"`
+}
+
+// ChangePasswordForm contains the current and the new password of the logged-in user
+type ChangePasswordForm struct {
+	OldPassword string `form:"old_password" json:"old_password" binding:"required,max=50"`
+	NewPassword string `form:"new_password" json:"new_password" binding:"required,min=3,max=50,nefield=OldPassword"`
+}
+
+// ForgotPassword validates the forgot password form and returns appropriate error messages
+func (f UserForm) ForgotPassword(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		for _, err := range err.(validator.ValidationErrors) {
+			if err.Field() == "Email" {
+				return f.Email(err.Tag())
+			}
+		}
+	default:
+		return "Invalid request"
+	}
+	return "Something went wrong, please try again later"
+}
+
+// ResetPassword validates the reset password form and returns appropriate error messages
+func (f UserForm) ResetPassword(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		for _, err := range err.(validator.ValidationErrors) {
+			if err.Field() == "Token" {
+				return "Please provide the reset code"
+			}
+			if err.Field() == "Password" {
+				return f.Password(err.Tag())
+			}
+		}
+	default:
+		return "Invalid request"
+	}
+	return "Something went wrong, please try again later"
+}
+
+// ChangePassword validates the change password form and returns appropriate error messages
+func (f UserForm) ChangePassword(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		for _, err := range err.(validator.ValidationErrors) {
+			if err.Field() == "OldPassword" {
+				return "Please enter your current password"
+			}
+			if err.Field() == "NewPassword" {
+				if err.Tag() == "nefield" {
+					return "Your new password should differ from the current one"
+				}
+				return f.Password(err.Tag())
+			}
+		}
+	default:
+		return "Invalid request"
+	}
+	return "Something went wrong, please try again later"
+}
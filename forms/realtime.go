@@ -0,0 +1,62 @@
+package forms
+
+import (
+	"encoding/json"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// RealtimeForm represents the base form structure for frames sent by realtime clients
+type RealtimeForm struct{}
+
+// ClientFrame represents a single JSON frame sent by a client over the WebSocket connection
+// ID is optional and echoed back in the reply so clients can correlate responses
+// Topic is optional, frames without it are sent to the general topic, a user ID sends a direct message
+// Type "pub" publishes the message body, "kp" tells the topic the user is typing and is acknowledged only on failure
+type ClientFrame struct {
+	ID      string `json:"id" binding:"max=64"`
+	Type    string `json:"type" binding:"required,oneof=pub kp"`
+	Topic   string `json:"topic" binding:"max=32"`
+	ReplyTo int32  `json:"reply_to" binding:"omitempty,min=1"`
+	MessageBody
+}
+
+// Type returns the appropriate error message for frame type validation tags
+func (f RealtimeForm) Type(tag string) string {
+	switch tag {
+	case "required":
+		return "Please provide frame type"
+	case "oneof":
+		return "Unknown frame type"
+	default:
+		return "Something went wrong, please try again later"
+	}
+}
+
+// Frame validates a ClientFrame and returns appropriate error messages
+func (f RealtimeForm) Frame(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			return "Something went wrong, please try again later"
+		}
+
+		for _, err := range err.(validator.ValidationErrors) {
+			if err.Field() == "Type" {
+				return f.Type(err.Tag())
+			}
+			if message, ok := (MessageForm{}).Body(err.Field(), err.Tag()); ok {
+				return message
+			}
+			if err.Field() == "Topic" {
+				return "Invalid topic id"
+			}
+			if err.Field() == "ID" {
+				return "Frame id can be up to 64 characters"
+			}
+		}
+	default:
+		return "Invalid frame"
+	}
+	return "Something went wrong, please try again later"
+}
@@ -0,0 +1,85 @@
+package forms
+
+import (
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/robfig/cron/v3"
+)
+
+// ScheduledMessage represents a message to publish later: once at SendAt or on the schedule of Cron
+// Topic is a group topic or a user for direct messages, the general topic if empty
+// Cron is a standard 5-field expression or a descriptor such as @daily, evaluated in UTC unless prefixed with CRON_TZ=
+type ScheduledMessage struct {
+	MessageBody
+	Topic   string     `json:"topic" binding:"omitempty,max=32"`
+	ReplyTo int32      `json:"reply_to" binding:"omitempty,min=1"`
+	SendAt  *time.Time `json:"send_at" binding:"required_without=Cron,excluded_with=Cron"`
+	Cron    string     `json:"cron" binding:"required_without=SendAt,omitempty,max=128,cron"`
+}
+
+// Schedule validates a ScheduledMessage and returns appropriate error messages
+func (f MessageForm) Schedule(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		for _, err := range err.(validator.ValidationErrors) {
+			if message, ok := f.Body(err.Field(), err.Tag()); ok {
+				return message
+			}
+			switch err.Field() {
+			case "Topic":
+				return "Invalid topic id"
+			case "SendAt", "Cron":
+				switch err.Tag() {
+				case "required_without", "excluded_with":
+					return "Please provide either a send time or a cron expression"
+				case "future":
+					return "Send time must be in the future"
+				default:
+					return "Invalid cron expression, recurring messages can be sent at most every 5 minutes"
+				}
+			}
+		}
+	default:
+		return "Invalid request"
+	}
+	return "Something went wrong, please try again later"
+}
+
+// minCronInterval is the shortest interval allowed between two runs of a recurring message
+const minCronInterval = 5 * time.Minute
+
+// cronCheckWindow is how far ahead the runs of a recurring message are checked against minCronInterval
+const cronCheckWindow = 7 * 24 * time.Hour
+
+// validateCron checks that the field is a cron expression the scheduler understands
+// and that it does not run more often than every minCronInterval
+func validateCron(fl validator.FieldLevel) bool {
+	schedule, err := cron.ParseStandard(fl.Field().String())
+	if err != nil {
+		return false
+	}
+
+	// runs may be unevenly spaced (e.g. "0,1 * * * *"), so every run in the window is checked
+	now := time.Now()
+	prev := schedule.Next(now)
+	for !prev.IsZero() && prev.Sub(now) < cronCheckWindow {
+		next := schedule.Next(prev)
+		if !next.IsZero() && next.Sub(prev) < minCronInterval {
+			return false
+		}
+		prev = next
+	}
+	return true
+}
+
+// validateScheduledMessage checks that the message has content and one-time messages are sent in the future
+func validateScheduledMessage(sl validator.StructLevel) {
+	msg := sl.Current().Interface().(ScheduledMessage)
+	if !msg.hasContent() {
+		sl.ReportError(msg.Content, "Content", "Content", "required", "")
+	}
+	if msg.SendAt != nil && !msg.SendAt.After(time.Now()) {
+		sl.ReportError(msg.SendAt, "SendAt", "SendAt", "future", "")
+	}
+}
@@ -0,0 +1,27 @@
+package forms
+
+import "testing"
+
+func TestValidateCron(t *testing.T) {
+	tests := []struct {
+		cron string
+		want bool
+	}{
+		{cron: "CRON_TZ=Europe/Moscow 0 9 * * 1-5", want: true},
+		{cron: "*/5 * * * *", want: true},
+		{cron: "@daily", want: true},
+		{cron: "* * * * *", want: false},
+		{cron: "0,1 * * * *", want: false},
+		{cron: "@every 30s", want: false},
+		{cron: "not a cron", want: false},
+	}
+
+	var v DefaultValidator
+	for _, tt := range tests {
+		form := ScheduledMessage{MessageBody: MessageBody{Content: "hello"}, Cron: tt.cron}
+		err := v.ValidateStruct(form)
+		if got := err == nil; got != tt.want {
+			t.Errorf("cron %q: valid = %v, want %v (error: %v)", tt.cron, got, tt.want, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package forms
+
+import (
+	"time"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// SearchForm represents the base form structure for search-related forms
+type SearchForm struct{}
+
+// SearchQuery represents a full-text search of messages
+// Q is a MongoDB text search: words, "exact phrases" and -excluded words
+// Topic is a group topic or a user for direct messages, From the author of the messages,
+// Since and Until limit the results to messages sent in [Since, Until) (RFC 3339 timestamps),
+// Cursor is the opaque next_cursor of the previous page and Limit must be between 1 and 100 (20 by default)
+type SearchQuery struct {
+	Q      string    `form:"q" binding:"required,min=1,max=256"`
+	Topic  string    `form:"topic" binding:"omitempty,max=32"`
+	From   string    `form:"from" binding:"omitempty,max=32"`
+	Since  time.Time `form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Until  time.Time `form:"until" time_format:"2006-01-02T15:04:05Z07:00" binding:"omitempty,gtfield=Since"`
+	Cursor string    `form:"cursor" binding:"omitempty,max=64"`
+	Limit  int64     `form:"limit" binding:"omitempty,min=1,max=100"`
+}
+
+// Search validates a SearchQuery and returns appropriate error messages
+func (f SearchForm) Search(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		for _, err := range err.(validator.ValidationErrors) {
+			switch err.Field() {
+			case "Q":
+				return "Search query can be from 1 to 256 characters"
+			case "Topic":
+				return "Invalid topic id"
+			case "From":
+				return "Invalid user id"
+			case "Until":
+				return "Until must be later than since"
+			case "Cursor":
+				return "Invalid cursor"
+			case "Limit":
+				return "Limit can be from 1 to 100"
+			}
+		}
+	default:
+		return "Invalid query"
+	}
+	return "Something went wrong, please try again later"
+}
@@ -0,0 +1,79 @@
+package forms
+
+import (
+	"encoding/json"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// TopicForm represents the base form structure for topic-related forms
+type TopicForm struct{}
+
+// CreateTopicForm contains the fields required to create a group topic
+// Auth and Anon are the default access modes of the topic, "JRWPA" and "N" if omitted
+type CreateTopicForm struct {
+	Name        string `form:"name" json:"name" binding:"required,min=1,max=64"`
+	Description string `form:"description" json:"description" binding:"max=512"`
+	Auth        string `form:"auth" json:"auth" binding:"omitempty,acsmode"`
+	Anon        string `form:"anon" json:"anon" binding:"omitempty,acsmode"`
+}
+
+// ReceiptForm contains the seq ID of the latest message read or received by the user
+type ReceiptForm struct {
+	SeqID int32 `form:"seq_id" json:"seq_id" binding:"required,min=1"`
+}
+
+// Name returns the appropriate error message for topic name validation tags
+func (f TopicForm) Name(tag string) string {
+	switch tag {
+	case "required":
+		return "Please provide topic name"
+	case "min", "max":
+		return "Topic name can be from 1 to 64 characters"
+	default:
+		return "Something went wrong, please try again later"
+	}
+}
+
+// Create validates a CreateTopicForm and returns appropriate error messages
+func (f TopicForm) Create(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			return "Something went wrong, please try again later"
+		}
+
+		for _, err := range err.(validator.ValidationErrors) {
+			switch err.Field() {
+			case "Name":
+				return f.Name(err.Tag())
+			case "Description":
+				return "Topic description can be up to 512 characters"
+			case "Auth", "Anon":
+				return "Access mode must be N or a combination of JRWPASDO"
+			}
+		}
+	default:
+		return "Invalid request"
+	}
+	return "Something went wrong, please try again later"
+}
+
+// Receipt validates a ReceiptForm and returns appropriate error messages
+func (f TopicForm) Receipt(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			return "Something went wrong, please try again later"
+		}
+
+		for _, err := range err.(validator.ValidationErrors) {
+			if err.Field() == "SeqID" {
+				return "Please provide a valid message seq id"
+			}
+		}
+	default:
+		return "Invalid request"
+	}
+	return "Something went wrong, please try again later"
+}
@@ -0,0 +1,35 @@
+package forms
+
+import (
+	"mime/multipart"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// UploadForm represents the base form structure for upload-related forms
+type UploadForm struct{}
+
+// FileUpload contains a file to be attached to messages of a topic
+// Topic is a group topic or a user for direct messages, the general topic if omitted
+type FileUpload struct {
+	Topic string                `form:"topic" binding:"omitempty,max=32"`
+	File  *multipart.FileHeader `form:"file" binding:"required"`
+}
+
+// Upload validates a FileUpload and returns appropriate error messages
+func (f UploadForm) Upload(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		for _, err := range err.(validator.ValidationErrors) {
+			switch err.Field() {
+			case "Topic":
+				return "Invalid topic id"
+			case "File":
+				return "Please provide a file"
+			}
+		}
+	default:
+		return "Invalid request"
+	}
+	return "Something went wrong, please try again later"
+}
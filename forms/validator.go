@@ -2,7 +2,10 @@ package forms
 
 import (
 	"reflect"
+	"regexp"
+	"strings"
 	"sync"
+	"unicode"
 
 	"github.com/gin-gonic/gin/binding"
 	"github.com/go-playground/validator/v10"
@@ -47,10 +50,59 @@ func (v *DefaultValidator) lazyinit() {
 		v.validate.SetTagName("binding")
 
 		// add any custom validations etc. here
+		v.validate.RegisterValidation("acsmode", validateAcsMode)
+		v.validate.RegisterValidation("emoji", validateEmoji)
+		v.validate.RegisterValidation("cron", validateCron)
+		v.validate.RegisterStructValidation(validateDrafty, DraftyDocument{})
+		v.validate.RegisterStructValidation(validateTextMessage, TextMessage{})
+		v.validate.RegisterStructValidation(validateClientFrame, ClientFrame{})
+		v.validate.RegisterStructValidation(validateScheduledMessage, ScheduledMessage{})
 
 	})
 }
 
+// acsModePattern matches Tinode access modes, e.g. "JRWPA" or "N" for no access
+var acsModePattern = regexp.MustCompile(`^(N|[JRWPASDO]+)$`)
+
+// validateAcsMode checks that the field is a valid Tinode access mode
+func validateAcsMode(fl validator.FieldLevel) bool {
+	return acsModePattern.MatchString(fl.Field().String())
+}
+
+// validateEmoji checks that the field is an emoji: symbols joined by emoji modifiers,
+// e.g. skin tones, variation selectors, zero width joiners or keycaps
+func validateEmoji(fl validator.FieldLevel) bool {
+	symbol := false
+	for _, r := range fl.Field().String() {
+		switch {
+		case unicode.Is(unicode.So, r):
+			symbol = true
+		case unicode.In(r, unicode.Sk, unicode.Mn, unicode.Me):
+		case r == '\u200d', r >= 0xe0020 && r <= 0xe007f:
+			// zero width joiner and tags of subdivision flags
+		case r == '#', r == '*', r >= '0' && r <= '9':
+			// keycaps, followed by a combining enclosing keycap
+		default:
+			return false
+		}
+	}
+	return symbol || strings.ContainsRune(fl.Field().String(), '\u20e3')
+}
+
+// validateTextMessage checks that the message has content
+func validateTextMessage(sl validator.StructLevel) {
+	if msg := sl.Current().Interface().(TextMessage); !msg.hasContent() {
+		sl.ReportError(msg.Content, "Content", "Content", "required", "")
+	}
+}
+
+// validateClientFrame checks that published frames have content
+func validateClientFrame(sl validator.StructLevel) {
+	if frame := sl.Current().Interface().(ClientFrame); frame.Type == "pub" && !frame.hasContent() {
+		sl.ReportError(frame.Content, "Content", "Content", "required", "")
+	}
+}
+
 // kindOfData returns the reflection Kind of the passed data
 // If the data is a pointer, it returns the Kind of the referenced value
 func kindOfData(data interface{}) reflect.Kind {
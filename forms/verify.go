@@ -0,0 +1,45 @@
+package forms
+
+import (
+	"github.com/go-playground/validator/v10"
+)
+
+// VerifyForm contains the token mailed to the user to verify the email
+type VerifyForm struct {
+	Token string `form:"token" json:"token" binding:"required,max=128"`
+}
+
+// ResendForm contains the email a new verification token is mailed to
+type ResendForm struct {
+	Email string `form:"email" json:"email" binding:"required,email"`
+}
+
+// Verify validates the verification form and returns appropriate error messages
+func (f UserForm) Verify(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		for _, err := range err.(validator.ValidationErrors) {
+			if err.Field() == "Token" {
+				return "Please provide the verification code"
+			}
+		}
+	default:
+		return "Invalid request"
+	}
+	return "Something went wrong, please try again later"
+}
+
+// Resend validates the resend form and returns appropriate error messages
+func (f UserForm) Resend(err error) string {
+	switch err.(type) {
+	case validator.ValidationErrors:
+		for _, err := range err.(validator.ValidationErrors) {
+			if err.Field() == "Email" {
+				return f.Email(err.Tag())
+			}
+		}
+	default:
+		return "Invalid request"
+	}
+	return "Something went wrong, please try again later"
+}
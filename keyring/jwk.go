@@ -0,0 +1,43 @@
+package keyring
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+// JWKS is a JSON Web Key Set (RFC 7517), served to other services verifying our tokens
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is the public part of a signing key: an RSA key (kty RSA, n and e)
+// or an Ed25519 key (kty OKP, crv and x, RFC 8037)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// publicJWK returns the JWK of the public key of key
+func publicJWK(key *Key) JWK {
+	jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+
+	switch pub := key.Signer.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+	return jwk
+}
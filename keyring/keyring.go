@@ -0,0 +1,216 @@
+package keyring
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// keyExt is the extension of key files, the rest of the file name is the key ID
+const keyExt = ".pem"
+
+// activationLayout is the date prefix of key IDs that schedules when the key starts signing tokens
+const activationLayout = "2006-01-02"
+
+// ErrNoSigningKey is returned when no key of the keyring is active yet
+var ErrNoSigningKey = errors.New("no active signing key")
+
+// Key is a private key of the keyring
+type Key struct {
+	ID       string
+	Method   jwt.SigningMethod // RS256 for RSA keys, EdDSA for Ed25519 keys
+	Signer   crypto.Signer
+	ActiveAt time.Time // Time the key starts signing tokens, zero for keys active right away
+}
+
+// Keyring holds the keys tokens are signed and verified with, loaded from PEM files named <kid>.pem.
+// The active key with the latest activation signs new tokens, all keys verify them, so a key is rotated out
+// by adding a newer one and removed once the tokens it signed have expired.
+// Key IDs starting with a date (e.g. 2026-11-01.pem) become active on that date, UTC.
+type Keyring struct {
+	dir string
+
+	mu   sync.RWMutex
+	keys map[string]*Key
+}
+
+// Load reads the keys from the PEM files in dir, it fails if there are none
+func Load(dir string) (*Keyring, error) {
+	k := &Keyring{dir: dir}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload replaces the keys with the ones currently in the directory.
+// If any file can not be read, the keys are left as they are.
+func (k *Keyring) Reload() error {
+	paths, err := filepath.Glob(filepath.Join(k.dir, "*"+keyExt))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no %s keys in %s", keyExt, k.dir)
+	}
+
+	keys := make(map[string]*Key, len(paths))
+	for _, path := range paths {
+		key, err := readKey(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		keys[key.ID] = key
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	return nil
+}
+
+// Watch reloads the keys every interval until ctx is canceled, so keys can be rotated without a restart
+func (k *Keyring) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := k.Reload(); err != nil {
+			slog.Error("failed to reload keyring, keeping the current keys", "error", err, "dir", k.dir)
+		}
+	}
+}
+
+// readKey parses a PKCS #8 (RSA or Ed25519) or PKCS #1 (RSA) private key
+func readKey(path string) (*Key, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var priv any
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: strings.TrimSuffix(filepath.Base(path), keyExt)}
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		if priv.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits long")
+		}
+		key.Method, key.Signer = jwt.SigningMethodRS256, priv
+	case ed25519.PrivateKey:
+		key.Method, key.Signer = jwt.SigningMethodEdDSA, priv
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, expected RSA or Ed25519", priv)
+	}
+
+	if len(key.ID) >= len(activationLayout) {
+		if at, err := time.Parse(activationLayout, key.ID[:len(activationLayout)]); err == nil {
+			key.ActiveAt = at
+		}
+	}
+	return key, nil
+}
+
+// signingKey returns the active key with the latest activation, ties are broken by the greatest key ID
+func (k *Keyring) signingKey(now time.Time) (*Key, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	var signing *Key
+	for _, key := range k.keys {
+		if key.ActiveAt.After(now) {
+			continue
+		}
+		if signing == nil || key.ActiveAt.After(signing.ActiveAt) ||
+			(key.ActiveAt.Equal(signing.ActiveAt) && key.ID > signing.ID) {
+			signing = key
+		}
+	}
+	if signing == nil {
+		return nil, ErrNoSigningKey
+	}
+	return signing, nil
+}
+
+// Sign signs the claims with the current signing key, the token header names the key in "kid"
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	key, err := k.signingKey(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Signer)
+}
+
+// Keyfunc returns the public key the token was signed with, for use with jwt.Parse.
+// Keys are looked up by "kid", the algorithm must match the key's.
+func (k *Keyring) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	k.mu.RLock()
+	key, ok := k.keys[kid]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Signer.Public(), nil
+}
+
+// Methods returns the names of the algorithms tokens may be signed with
+func (k *Keyring) Methods() []string {
+	return []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+}
+
+// JWKS returns the public keys of the keyring, including the ones not active yet,
+// so verifiers learn about a key before it signs any token
+func (k *Keyring) JWKS() JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := JWKS{Keys: make([]JWK, 0, len(k.keys))}
+	for _, key := range k.keys {
+		set.Keys = append(set.Keys, publicJWK(key))
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
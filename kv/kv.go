@@ -1,6 +1,12 @@
 package kv
 
-import "time"
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by Get when the key does not exist
+var ErrNotFound = errors.New("key not found")
 
 // KeyValueStore represents an interface for a key-value storage system
 // providing basic operations like Set, Get and Delete
@@ -11,4 +17,17 @@ type KeyValueStore interface {
 	Get(key string) (string, error)
 	// Del removes the key-value pair and returns the deleted key
 	Del(key string) (string, error)
+	// SAdd adds members to the set stored at key
+	SAdd(key string, members ...string) error
+	// SRem removes members from the set stored at key
+	SRem(key string, members ...string) error
+	// SMembers returns all members of the set stored at key
+	SMembers(key string) ([]string, error)
+	// SetNX stores a key-value pair only if the key does not exist, reports whether it was stored
+	SetNX(key, value string, exp time.Duration) (bool, error)
+	// Refresh resets the expiration of the key if it still holds value, reports whether it did
+	Refresh(key, value string, exp time.Duration) (bool, error)
+	// SetWith stores a key-value pair expiring together with the owner key, only if the owner exists.
+	// Reports whether it was stored.
+	SetWith(key, value, owner string) (bool, error)
 }
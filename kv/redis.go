@@ -47,9 +47,13 @@ func (r *RedisKV) Del(key string) (string, error) {
 }
 
 // Get retrieves a value from Redis by key.
-// Returns the value and nil if successful, or empty string and error if the key doesn't exist.
+// Returns the value and nil if successful, or empty string and ErrNotFound if the key doesn't exist.
 func (r *RedisKV) Get(key string) (string, error) {
-	return r.client.Get(key).Result()
+	value, err := r.client.Get(key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNotFound
+	}
+	return value, err
 }
 
 // Set stores a key-value pair in Redis with an optional expiration duration.
@@ -57,3 +61,68 @@ func (r *RedisKV) Get(key string) (string, error) {
 func (r *RedisKV) Set(key string, value string, exp time.Duration) error {
 	return r.client.Set(key, value, exp).Err()
 }
+
+// SAdd adds members to the Redis set stored at key, creating the set if needed.
+func (r *RedisKV) SAdd(key string, members ...string) error {
+	values := make([]interface{}, len(members))
+	for i, m := range members {
+		values[i] = m
+	}
+	return r.client.SAdd(key, values...).Err()
+}
+
+// SRem removes members from the Redis set stored at key.
+// Removing members that are not in the set is not an error.
+func (r *RedisKV) SRem(key string, members ...string) error {
+	values := make([]interface{}, len(members))
+	for i, m := range members {
+		values[i] = m
+	}
+	return r.client.SRem(key, values...).Err()
+}
+
+// refreshScript resets the expiration of KEYS[1] to ARGV[2] milliseconds if it holds ARGV[1]
+var refreshScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// setWithScript stores ARGV[1] at KEYS[1] with the remaining expiration of KEYS[2], if KEYS[2] exists
+var setWithScript = redis.NewScript(`
+local ttl = redis.call("PTTL", KEYS[2])
+if ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ttl)
+	return 1
+elseif ttl == -1 then
+	redis.call("SET", KEYS[1], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// SetNX stores a key-value pair in Redis only if the key does not exist yet.
+// Returns true if the pair was stored, false if the key already exists.
+func (r *RedisKV) SetNX(key, value string, exp time.Duration) (bool, error) {
+	return r.client.SetNX(key, value, exp).Result()
+}
+
+// Refresh resets the expiration of the key atomically, provided it still holds value.
+// Returns false if the key is missing or holds another value.
+func (r *RedisKV) Refresh(key, value string, exp time.Duration) (bool, error) {
+	n, err := refreshScript.Run(r.client, []string{key}, value, exp.Milliseconds()).Int64()
+	return n == 1, err
+}
+
+// SetWith stores a key-value pair in Redis expiring together with the owner key, atomically.
+// Returns false if the owner key is missing.
+func (r *RedisKV) SetWith(key, value, owner string) (bool, error) {
+	n, err := setWithScript.Run(r.client, []string{key, owner}, value).Int64()
+	return n == 1, err
+}
+
+// SMembers returns all members of the Redis set stored at key, or an empty slice if the key doesn't exist.
+func (r *RedisKV) SMembers(key string) ([]string, error) {
+	return r.client.SMembers(key).Result()
+}
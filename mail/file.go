@@ -0,0 +1,45 @@
+package mail
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FileMailer implements Mailer by writing each message as an .eml file to a directory,
+// for development and tests
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+var _ Mailer = (*FileMailer)(nil)
+
+// NewFileMailer creates a FileMailer writing to dir, the directory is created if needed
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+// Send writes the message to a new file named after the time it was sent
+func (m *FileMailer) Send(_ context.Context, msg Message) error {
+	name := time.Now().UTC().Format("20060102T150405") + "-" + uuid.NewString() + ".eml"
+	return os.WriteFile(filepath.Join(m.dir, name), msg.encode(m.from), 0o640)
+}
+
+// LogMailer implements Mailer by logging messages instead of sending them, for development
+type LogMailer struct{}
+
+var _ Mailer = LogMailer{}
+
+// Send logs the message
+func (LogMailer) Send(_ context.Context, msg Message) error {
+	slog.Info("mail", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
@@ -0,0 +1,54 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Mailer sends emails to users
+type Mailer interface {
+	// Send delivers the message, returns once it is handed over to the transport
+	Send(ctx context.Context, msg Message) error
+}
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// encode formats the message as an RFC 5322 email, headers are sanitized against injection
+func (m Message) encode(from string) []byte {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+
+	header("From", from)
+	header("To", m.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+uuid.NewString()+"@"+domain(from)+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", `text/plain; charset="utf-8"`)
+	header("Content-Transfer-Encoding", "8bit")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// domain returns the domain of the address, used in message IDs
+func domain(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return strings.Trim(addr[i+1:], "> ")
+	}
+	return "localhost"
+}
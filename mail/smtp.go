@@ -0,0 +1,91 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTPConfig holds the settings of the SMTP server mail is relayed through
+type SMTPConfig struct {
+	Addr     string // host:port, e.g. "smtp.example.com:587"
+	Username string // empty for servers without authentication, e.g. a local stub
+	Password string
+	From     string
+	Timeout  time.Duration
+}
+
+// SMTPMailer implements Mailer by relaying messages through an SMTP server.
+// STARTTLS is used whenever the server offers it.
+type SMTPMailer struct {
+	cfg SMTPConfig
+}
+
+var _ Mailer = (*SMTPMailer)(nil)
+
+// NewSMTPMailer creates an SMTPMailer, the server is contacted for each message
+func NewSMTPMailer(cfg SMTPConfig) *SMTPMailer {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	return &SMTPMailer{cfg: cfg}
+}
+
+// Send delivers the message to the SMTP server
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	ctx, cancel := context.WithTimeout(ctx, m.cfg.Timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	// net/smtp does not take a context, the deadline bounds the whole conversation instead
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, err := net.SplitHostPort(m.cfg.Addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.cfg.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.encode(m.cfg.From)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/dartt0n/realtime-chat-backend/blob"
 	"github.com/dartt0n/realtime-chat-backend/controllers"
+	"github.com/dartt0n/realtime-chat-backend/db"
 	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/keyring"
 	"github.com/dartt0n/realtime-chat-backend/kv"
+	"github.com/dartt0n/realtime-chat-backend/mail"
 	"github.com/dartt0n/realtime-chat-backend/models"
 	"github.com/dartt0n/realtime-chat-backend/service"
 	"github.com/gin-contrib/gzip"
@@ -20,12 +29,15 @@ import (
 	"github.com/gin-gonic/gin/binding"
 )
 
+// allowedOrigin is the frontend origin allowed to make cross-origin requests
+const allowedOrigin = "http://localhost"
+
 // CORS (Cross-Origin Resource Sharing)
 func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "http://localhost")
+		c.Writer.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
 		c.Writer.Header().Set("Access-Control-Max-Age", "86400")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, UPDATE")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE, UPDATE")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "X-Requested-With, Content-Type, Origin, Authorization, Accept, Client-Security-Token, Accept-Encoding, x-access-token")
 		c.Writer.Header().Set("Access-Control-Expose-Headers", "Content-Length")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
@@ -56,16 +68,119 @@ func SlogMiddleware(logger *slog.Logger) gin.HandlerFunc {
 	}
 }
 
-var auth = new(controllers.AuthController)
+// QueryTokenMiddleware accepts the access token from the token query parameter on WebSocket and SSE routes:
+// browsers cannot set headers on WebSocket and EventSource requests. Other routes take the header only,
+// as URLs end up in logs.
+func QueryTokenMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			if token := c.Query("token"); token != "" {
+				c.Request.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+		c.Next()
+	}
+}
 
 // JWT Authentication middleware attached to each request that needs to be authenitcated to validate the access_token in the header
-func TokenAuthMiddleware() gin.HandlerFunc {
+func TokenAuthMiddleware(auth *controllers.AuthController) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		auth.TokenValid(c)
 		c.Next()
 	}
 }
 
+// mongoConfig reads the MongoDB pool settings from the environment, unset variables keep their defaults
+func mongoConfig() (cfg db.MongoConfig, err error) {
+	cfg = db.DefaultMongoConfig(os.Getenv("DB_URI"))
+
+	if raw := os.Getenv("DB_MAX_POOL_SIZE"); raw != "" {
+		if cfg.MaxPoolSize, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			return cfg, fmt.Errorf("DB_MAX_POOL_SIZE: %w", err)
+		}
+	}
+	if raw := os.Getenv("DB_MIN_POOL_SIZE"); raw != "" {
+		if cfg.MinPoolSize, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			return cfg, fmt.Errorf("DB_MIN_POOL_SIZE: %w", err)
+		}
+	}
+	if raw := os.Getenv("DB_CONNECT_TIMEOUT"); raw != "" {
+		if cfg.ConnectTimeout, err = time.ParseDuration(raw); err != nil {
+			return cfg, fmt.Errorf("DB_CONNECT_TIMEOUT: %w", err)
+		}
+	}
+	if raw := os.Getenv("DB_TIMEOUT"); raw != "" {
+		if cfg.Timeout, err = time.ParseDuration(raw); err != nil {
+			return cfg, fmt.Errorf("DB_TIMEOUT: %w", err)
+		}
+	}
+	if raw := os.Getenv("DB_HISTORY_READ_PREF"); raw != "" {
+		cfg.HistoryReadPref = raw
+	}
+
+	return cfg, nil
+}
+
+// blobStore creates the store of uploaded files selected by BLOB_STORE
+func blobStore(ctx context.Context) (blob.BlobStore, error) {
+	switch os.Getenv("BLOB_STORE") {
+	case "", "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "./uploads"
+		}
+		return blob.NewLocalStore(dir)
+	case "s3":
+		useSSL, _ := strconv.ParseBool(os.Getenv("S3_SSL"))
+		return blob.NewS3Store(ctx, blob.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			UseSSL:    useSSL,
+		})
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q, expected local or s3", os.Getenv("BLOB_STORE"))
+	}
+}
+
+// tinodeRootSecret returns the basic auth secret of the Tinode root user, empty if no root user is configured
+func tinodeRootSecret() string {
+	login := os.Getenv("TINODE_ROOT_LOGIN")
+	if login == "" {
+		return ""
+	}
+	return login + ":" + os.Getenv("TINODE_ROOT_PASSWORD")
+}
+
+// mailer creates the mailer selected by MAILER
+func mailer() (mail.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	switch os.Getenv("MAILER") {
+	case "", "log":
+		return mail.LogMailer{}, nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "./outbox"
+		}
+		return mail.NewFileMailer(dir, from)
+	case "smtp":
+		return mail.NewSMTPMailer(mail.SMTPConfig{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q, expected log, file or smtp", os.Getenv("MAILER"))
+	}
+}
+
 func main() {
 	var err error
 
@@ -89,8 +204,10 @@ func main() {
 	}
 	slog.SetDefault(logger)
 
-	//Start the default gin server
-	r := gin.Default()
+	// requests are logged by SlogMiddleware, which leaves the query (and tokens passed in it) out,
+	// so gin's own logger printing the full URI is not used
+	r := gin.New()
+	r.Use(gin.Recovery())
 
 	//Custom form validator
 	binding.Validator = new(forms.DefaultValidator)
@@ -98,7 +215,8 @@ func main() {
 	r.Use(CORSMiddleware())
 	r.Use(requestid.New(requestid.WithCustomHeaderStrKey("X-Request-Id")))
 	r.Use(SlogMiddleware(logger))
-	r.Use(gzip.Gzip(gzip.DefaultCompression))
+	// long-lived streaming endpoints must not be buffered by the gzip writer
+	r.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPaths([]string{"/ws", "/events"})))
 
 	redisDb, err := strconv.ParseInt(os.Getenv("REDIS_DB"), 0, 0)
 	if err != nil {
@@ -111,50 +229,245 @@ func main() {
 		os.Exit(1)
 	}
 
-	authService := service.NewAuthService(redisKV)
+	sessionIdle := 10 * time.Minute
+	if raw := os.Getenv("TINODE_SESSION_IDLE"); raw != "" {
+		sessionIdle, err = time.ParseDuration(raw)
+		// idle sessions are looked for every half of the period, which must not round down to zero
+		if err != nil || sessionIdle < time.Second {
+			slog.Error("failed to parse TINODE_SESSION_IDLE env variable, expected at least 1s", "error", err, "value", raw)
+			os.Exit(1)
+		}
+	}
+
+	mongoCfg, err := mongoConfig()
+	if err != nil {
+		slog.Error("failed to parse database env variables", "error", err)
+		os.Exit(1)
+	}
+	mongoCtx, cancel := context.WithTimeout(context.Background(), mongoCfg.ConnectTimeout)
+	mongoDB, err := db.NewMongo(mongoCtx, mongoCfg)
+	cancel()
+	if err != nil {
+		slog.Error("failed to connect to database", "error", err)
+		os.Exit(1)
+	}
+
+	var presence service.PresenceStore
+	switch os.Getenv("PRESENCE_STORE") {
+	case "", "memory":
+		presence = service.NewMemoryPresence()
+	case "redis":
+		// shared by all replicas of the backend
+		presence = service.NewKVPresence(redisKV)
+	default:
+		slog.Error("unknown PRESENCE_STORE, expected memory or redis", "store", os.Getenv("PRESENCE_STORE"))
+		os.Exit(1)
+	}
+
+	keysDir := os.Getenv("JWT_KEYS_DIR")
+	if keysDir == "" {
+		keysDir = "./keys"
+	}
+	keys, err := keyring.Load(keysDir)
+	if err != nil {
+		slog.Error("failed to load signing keys", "error", err)
+		os.Exit(1)
+	}
+	keysReload := time.Minute
+	if raw := os.Getenv("JWT_KEYS_RELOAD"); raw != "" {
+		keysReload, err = time.ParseDuration(raw)
+		if err != nil || keysReload <= 0 {
+			slog.Error("failed to parse JWT_KEYS_RELOAD env variable", "error", err, "value", raw)
+			os.Exit(1)
+		}
+	}
+
+	hub := service.NewHub()
+	authService := service.NewAuthService(redisKV, keys)
 	tinodeService, err := service.NewTinodeService(
 		os.Getenv("TINODE_ADDR"),
 		models.Topic{ID: os.Getenv("TINODE_TOPIC_ID"), Name: "general"},
-		os.Getenv("DB_URI"), os.Getenv("DB_NAME"),
-		redisKV, authService)
+		mongoDB.History(os.Getenv("DB_NAME")),
+		redisKV, authService, hub, presence, sessionIdle, tinodeRootSecret())
 	if err != nil {
 		slog.Error("failed to connect to tinode", "error", err)
 		os.Exit(1)
 	}
 
-	health := controllers.NewHealthController()
+	indexCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// search is unavailable without the index, the rest of the service keeps working
+	if err := tinodeService.EnsureSearchIndex(indexCtx); err != nil {
+		slog.Warn("message search is unavailable", "error", err)
+	}
+	cancel()
+
+	scheduleService := service.NewScheduleService(
+		mongoDB.Database(os.Getenv("DB_NAME")).Collection("scheduled_messages"), redisKV, tinodeService)
+	indexCtx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	if err := scheduleService.EnsureIndexes(indexCtx); err != nil {
+		slog.Error("failed to create scheduled message indexes", "error", err)
+		os.Exit(1)
+	}
+	cancel()
+
+	// background workers run until the server shuts down
+	workers, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	// rotated keys are picked up without a restart
+	go keys.Watch(workers, keysReload)
+	// scheduled messages are published on behalf of their authors by the Tinode root user
+	if os.Getenv("TINODE_ROOT_LOGIN") != "" {
+		go scheduleService.Run(workers)
+	} else {
+		slog.Warn("scheduled messages are unavailable, TINODE_ROOT_LOGIN is not set")
+	}
+
+	blobCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	blobs, err := blobStore(blobCtx)
+	cancel()
+	if err != nil {
+		slog.Error("failed to open blob store", "error", err)
+		os.Exit(1)
+	}
+
+	uploadMaxSize := int64(10 << 20)
+	if raw := os.Getenv("UPLOAD_MAX_SIZE"); raw != "" {
+		uploadMaxSize, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || uploadMaxSize <= 0 {
+			slog.Error("failed to parse UPLOAD_MAX_SIZE env variable", "error", err, "value", raw)
+			os.Exit(1)
+		}
+	}
+
+	mails, err := mailer()
+	if err != nil {
+		slog.Error("failed to create mailer", "error", err)
+		os.Exit(1)
+	}
+	verifyService := service.NewVerifyService(redisKV, mails, os.Getenv("VERIFY_URL"))
+	passwordService := service.NewPasswordService(redisKV, mails, tinodeService, authService, os.Getenv("PASSWORD_RESET_URL"))
+
+	health := controllers.NewHealthController(tinodeService)
 	r.GET("/health", health.Health)
 
-	user := controllers.NewUserController(tinodeService, authService)
+	user := controllers.NewUserController(tinodeService, authService, verifyService)
 	r.POST("/signup", user.Register)
 	r.POST("/login", user.Login)
 	r.GET("/logout", user.Logout)
 
+	verify := controllers.NewVerifyController(verifyService)
+	r.POST("/verify", verify.Verify)
+	r.POST("/verify/resend", verify.Resend)
+
 	auth := controllers.NewAuthController(authService)
 	r.POST("/refresh", auth.Refresh)
+	r.GET("/.well-known/jwks.json", auth.JWKS)
+
+	session := controllers.NewSessionController(authService)
+	sessions := r.Group("/sessions", TokenAuthMiddleware(auth))
+	sessions.GET("", session.List)
+	sessions.DELETE("", session.RevokeAll)
+	sessions.DELETE("/:id", session.Revoke)
+
+	password := controllers.NewPasswordController(passwordService)
+	r.POST("/password/forgot", password.Forgot)
+	r.POST("/password/reset", password.Reset)
+	r.POST("/password/change", TokenAuthMiddleware(auth), password.Change)
 
 	msg := controllers.NewMessageController(tinodeService, authService)
-	r.GET("/messages", msg.FetchLast)
-	r.POST("/message", msg.SendMsg)
+	r.GET("/messages", TokenAuthMiddleware(auth), msg.Fetch)
+	r.POST("/message", TokenAuthMiddleware(auth), msg.Send)
+	r.PATCH("/messages/:seq", TokenAuthMiddleware(auth), msg.Edit)
+	r.DELETE("/messages/:seq", TokenAuthMiddleware(auth), msg.Delete)
+	r.GET("/messages/:seq/thread", TokenAuthMiddleware(auth), msg.Thread)
+	r.POST("/messages/:seq/reactions", TokenAuthMiddleware(auth), msg.React)
+	r.DELETE("/messages/:seq/reactions/:emoji", TokenAuthMiddleware(auth), msg.Unreact)
+
+	topic := controllers.NewTopicController(tinodeService)
+	topics := r.Group("/topics", TokenAuthMiddleware(auth))
+	topics.POST("", topic.Create)
+	topics.GET("", topic.List)
+	topics.GET("/unread", topic.Unread)
+	topics.POST("/:id/join", topic.Join)
+	topics.POST("/:id/leave", topic.Leave)
+	topics.POST("/:id/read", topic.Read)
+	topics.POST("/:id/recv", topic.Recv)
+	topics.POST("/:id/typing", topic.Typing)
+	topics.GET("/:id/online", topic.Online)
+	topics.GET("/:id/pins", topic.Pins)
+	topics.POST("/:id/pins/:seq", topic.Pin)
+	topics.DELETE("/:id/pins/:seq", topic.Unpin)
+	topics.GET("/:id/messages", msg.Fetch)
+	topics.POST("/:id/messages", msg.Send)
+	topics.PATCH("/:id/messages/:seq", msg.Edit)
+	topics.DELETE("/:id/messages/:seq", msg.Delete)
+	topics.GET("/:id/messages/:seq/thread", msg.Thread)
+	topics.POST("/:id/messages/:seq/reactions", msg.React)
+	topics.DELETE("/:id/messages/:seq/reactions/:emoji", msg.Unreact)
+
+	users := r.Group("/users", TokenAuthMiddleware(auth))
+	users.GET("/:id/messages", msg.FetchDirect)
+	users.POST("/:id/messages", msg.SendDirect)
+
+	schedule := controllers.NewScheduleController(scheduleService, tinodeService)
+	scheduled := r.Group("/messages/scheduled", TokenAuthMiddleware(auth))
+	scheduled.POST("", schedule.Create)
+	scheduled.GET("", schedule.List)
+	scheduled.DELETE("/:id", schedule.Cancel)
+
+	upload := controllers.NewUploadController(service.NewUploadService(blobs, tinodeService), tinodeService, uploadMaxSize)
+	r.POST("/uploads", TokenAuthMiddleware(auth), upload.Upload)
+	r.GET("/uploads/:topic/:id", TokenAuthMiddleware(auth), upload.Download)
+
+	search := controllers.NewSearchController(tinodeService)
+	r.GET("/search", TokenAuthMiddleware(auth), search.Search)
+
+	realtime := controllers.NewRealtimeController(tinodeService, authService, allowedOrigin)
+	r.GET("/ws", QueryTokenMiddleware(), TokenAuthMiddleware(auth), realtime.WebSocket)
+	r.GET("/events", QueryTokenMiddleware(), TokenAuthMiddleware(auth), realtime.Events)
 
 	port := os.Getenv("PORT")
 
 	slog.Info("server starting", "port", port, "env", os.Getenv("ENV"), "ssl", os.Getenv("SSL"))
 
-	if os.Getenv("SSL") == "TRUE" {
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+
+	go func() {
+		var err error
+		if os.Getenv("SSL") == "TRUE" {
+
+			//Generated using sh generate-certificate.sh
+			SSLKeys := &struct {
+				CERT string
+				KEY  string
+			}{
+				CERT: "./cert/myCA.cer",
+				KEY:  "./cert/myCA.key",
+			}
 
-		//Generated using sh generate-certificate.sh
-		SSLKeys := &struct {
-			CERT string
-			KEY  string
-		}{
-			CERT: "./cert/myCA.cer",
-			KEY:  "./cert/myCA.key",
+			err = srv.ListenAndServeTLS(SSLKeys.CERT, SSLKeys.KEY)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("server failed", "error", err)
+			os.Exit(1)
 		}
+	}()
 
-		r.RunTLS(":"+port, SSLKeys.CERT, SSLKeys.KEY)
-	} else {
-		r.Run(":" + port)
-	}
+	stop, cancelStop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelStop()
+	<-stop.Done()
+
+	slog.Info("server shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
+	stopWorkers()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to shut down server", "error", err)
+	}
+	if err := mongoDB.Close(shutdownCtx); err != nil {
+		slog.Error("failed to close database connections", "error", err)
+	}
 }
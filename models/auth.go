@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 // TokenDetails contains authentication token data including access and refresh tokens,
 // their UUIDs and expiration timestamps
 type TokenDetails struct {
@@ -7,6 +9,7 @@ type TokenDetails struct {
 	RefreshToken string
 	AccessUUID   string
 	RefreshUUID  string
+	FamilyID     string // Family of the token pairs issued by refreshes since a single login
 	AtExpires    int64
 	RtExpires    int64
 }
@@ -14,6 +17,7 @@ type TokenDetails struct {
 // AccessDetails contains the access token UUID and associated user ID
 type AccessDetails struct {
 	AccessUUID string
+	FamilyID   string
 	UserID     string
 }
 
@@ -23,3 +27,19 @@ type Token struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 }
+
+// ClientInfo describes the client a session was started from
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+// Session is a login of the user, kept alive by token refreshes until it expires or is revoked
+type Session struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"` // Whether the request listing the sessions was made with this session
+}
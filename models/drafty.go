@@ -0,0 +1,281 @@
+package models
+
+import (
+	"encoding/json"
+	"html"
+	"net/url"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Drafty is Tinode's rich text format: plain text with inline styles referencing entities
+// such as links, mentions or attachments. See https://github.com/tinode/chat/blob/master/docs/drafty.md
+type Drafty struct {
+	Txt string         `json:"txt" bson:"txt"`
+	Fmt []DraftyStyle  `json:"fmt,omitempty" bson:"fmt,omitempty"`
+	Ent []DraftyEntity `json:"ent,omitempty" bson:"ent,omitempty"`
+}
+
+// DraftyStyle styles Len characters of the text starting at At, either inline (Tp) or with an entity (Key)
+type DraftyStyle struct {
+	At  int    `json:"at" bson:"at"`
+	Len int    `json:"len" bson:"len"`
+	Tp  string `json:"tp,omitempty" bson:"tp,omitempty"`
+	Key int    `json:"key,omitempty" bson:"key,omitempty"`
+}
+
+// DraftyEntity is an object referenced by styles, e.g. {"tp": "LN", "data": {"url": "https://..."}}
+type DraftyEntity struct {
+	Tp   string         `json:"tp" bson:"tp"`
+	Data map[string]any `json:"data,omitempty" bson:"data,omitempty"`
+}
+
+// Content is the content of a Tinode message: either a plain string or a Drafty document
+type Content struct {
+	Text   string
+	Drafty *Drafty
+}
+
+// UnmarshalBSONValue decodes message content as stored by Tinode
+func (c *Content) UnmarshalBSONValue(typ byte, data []byte) error {
+	switch bson.Type(typ) {
+	case bson.TypeString:
+		return bson.UnmarshalValue(bson.TypeString, data, &c.Text)
+	case bson.TypeEmbeddedDocument:
+		c.Drafty = new(Drafty)
+		return bson.Unmarshal(data, c.Drafty)
+	default:
+		// content of unknown format is shown as an empty message
+		return nil
+	}
+}
+
+// MarshalBSONValue encodes message content the way Tinode stores it: a string or a Drafty document
+func (c Content) MarshalBSONValue() (byte, []byte, error) {
+	if c.Drafty != nil {
+		typ, data, err := bson.MarshalValue(c.Drafty)
+		return byte(typ), data, err
+	}
+	typ, data, err := bson.MarshalValue(c.Text)
+	return byte(typ), data, err
+}
+
+// MarshalJSON encodes the content the way Tinode clients send it: a string or a Drafty object
+func (c Content) MarshalJSON() ([]byte, error) {
+	if c.Drafty != nil {
+		return json.Marshal(c.Drafty)
+	}
+	return json.Marshal(c.Text)
+}
+
+// PlainText returns the text of the content without any formatting
+func (c Content) PlainText() string {
+	if c.Drafty != nil {
+		return c.Drafty.PlainText()
+	}
+	return c.Text
+}
+
+// HTML renders the content as HTML, all text is escaped
+func (c Content) HTML() string {
+	if c.Drafty != nil {
+		return c.Drafty.HTML()
+	}
+	return strings.ReplaceAll(html.EscapeString(c.Text), "\n", "<br>")
+}
+
+// Attachments returns the files attached to the content by reference
+func (c Content) Attachments() []Attachment {
+	if c.Drafty == nil {
+		return nil
+	}
+
+	var attachments []Attachment
+	for _, ent := range c.Drafty.Ent {
+		// EX are file attachments, IM are images
+		if ent.Tp != "EX" && ent.Tp != "IM" {
+			continue
+		}
+		// attachments sent inline (base64 "val") are not served by the backend
+		ref, _ := ent.Data["ref"].(string)
+		if ref == "" {
+			continue
+		}
+
+		a := Attachment{URL: ref}
+		a.MIME, _ = ent.Data["mime"].(string)
+		a.Name, _ = ent.Data["name"].(string)
+		// numbers decoded from JSON by Tinode are stored as doubles, but may be integers too
+		switch size := ent.Data["size"].(type) {
+		case float64:
+			a.Size = int64(size)
+		case int32:
+			a.Size = int64(size)
+		case int64:
+			a.Size = size
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments
+}
+
+// SafeURL reports whether the URL may be linked from rendered messages:
+// http(s) and mailto links, or paths of the backend such as uploads
+func SafeURL(raw string) bool {
+	if strings.HasPrefix(raw, "/") {
+		// protocol-relative URLs point to other hosts
+		return !strings.HasPrefix(raw, "//")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return true
+	default:
+		return false
+	}
+}
+
+// PlainText returns the text of the document, line breaks are restored
+func (d Drafty) PlainText() string {
+	txt := []rune(d.Txt)
+	for _, st := range d.Fmt {
+		// line breaks are styled spaces between the joined lines
+		if st.Tp == "BR" && st.Len == 1 && st.At >= 0 && st.At < len(txt) {
+			txt[st.At] = '\n'
+		}
+	}
+	return string(txt)
+}
+
+// draftySpan is a style applied to the text [at, end) with the styles nested in it
+type draftySpan struct {
+	at, end  int
+	style    *DraftyStyle
+	children []*draftySpan
+}
+
+// HTML renders the document as HTML. Overlapping styles are cut at the end of the enclosing style,
+// attachments outside of the text are rendered after it.
+func (d Drafty) HTML() string {
+	txt := []rune(d.Txt)
+
+	var styles, attachments []DraftyStyle
+	for _, st := range d.Fmt {
+		switch {
+		case st.At < 0:
+			attachments = append(attachments, st)
+		case st.At <= len(txt) && st.Len >= 0:
+			st.Len = min(st.Len, len(txt)-st.At)
+			styles = append(styles, st)
+		}
+	}
+	// enclosing styles come before the styles nested in them
+	sort.SliceStable(styles, func(i, j int) bool {
+		if styles[i].At != styles[j].At {
+			return styles[i].At < styles[j].At
+		}
+		return styles[i].Len > styles[j].Len
+	})
+
+	root := &draftySpan{end: len(txt)}
+	stack := []*draftySpan{root}
+	for i := range styles {
+		sp := &draftySpan{at: styles[i].At, end: styles[i].At + styles[i].Len, style: &styles[i]}
+		for len(stack) > 1 && sp.at >= stack[len(stack)-1].end {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1]
+		sp.end = min(sp.end, parent.end)
+		parent.children = append(parent.children, sp)
+		stack = append(stack, sp)
+	}
+
+	var b strings.Builder
+	d.renderSpan(&b, txt, root)
+	for i := range attachments {
+		open, close, _ := d.tags(&attachments[i])
+		b.WriteString(open)
+		b.WriteString(close)
+	}
+	return b.String()
+}
+
+// renderSpan writes the HTML of the span and the spans nested in it
+func (d Drafty) renderSpan(b *strings.Builder, txt []rune, sp *draftySpan) {
+	open, close, keepText := "", "", true
+	if sp.style != nil {
+		open, close, keepText = d.tags(sp.style)
+	}
+
+	b.WriteString(open)
+	if keepText {
+		pos := sp.at
+		for _, child := range sp.children {
+			b.WriteString(html.EscapeString(string(txt[pos:child.at])))
+			d.renderSpan(b, txt, child)
+			pos = child.end
+		}
+		b.WriteString(html.EscapeString(string(txt[pos:sp.end])))
+	}
+	b.WriteString(close)
+}
+
+// tags returns the HTML tags the styled text is wrapped in, and whether the text is rendered at all
+func (d Drafty) tags(st *DraftyStyle) (open, close string, keepText bool) {
+	switch st.Tp {
+	case "ST":
+		return "<b>", "</b>", true
+	case "EM":
+		return "<i>", "</i>", true
+	case "DL":
+		return "<s>", "</s>", true
+	case "CO":
+		return "<code>", "</code>", true
+	case "HL":
+		return "<mark>", "</mark>", true
+	case "BR":
+		return "<br>", "", false
+	case "HD":
+		return "", "", false
+	case "":
+		// styles without a type refer to entities
+	default:
+		return "", "", true
+	}
+
+	if st.Key < 0 || st.Key >= len(d.Ent) {
+		return "", "", true
+	}
+	ent := d.Ent[st.Key]
+	str := func(key string) string {
+		v, _ := ent.Data[key].(string)
+		return html.EscapeString(v)
+	}
+
+	switch ent.Tp {
+	case "LN":
+		if u, _ := ent.Data["url"].(string); SafeURL(u) {
+			return `<a href="` + str("url") + `" rel="nofollow noopener" target="_blank">`, "</a>", true
+		}
+	case "MN":
+		return `<span class="mention" data-user="` + str("val") + `">`, "</span>", true
+	case "HT":
+		return `<span class="hashtag">`, "</span>", true
+	case "IM":
+		if u, _ := ent.Data["ref"].(string); SafeURL(u) {
+			return `<img src="` + str("ref") + `" alt="` + str("name") + `">`, "", false
+		}
+	case "EX":
+		if u, _ := ent.Data["ref"].(string); SafeURL(u) {
+			return `<a href="` + str("ref") + `" download="` + str("name") + `">` + str("name") + `</a>`, "", false
+		}
+	}
+	return "", "", true
+}
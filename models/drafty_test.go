@@ -0,0 +1,140 @@
+package models
+
+import "testing"
+
+func TestDraftyHTML(t *testing.T) {
+	link := func(url string) DraftyEntity {
+		return DraftyEntity{Tp: "LN", Data: map[string]any{"url": url}}
+	}
+
+	tests := []struct {
+		name   string
+		drafty Drafty
+		html   string
+	}{
+		{
+			name:   "plain text is escaped",
+			drafty: Drafty{Txt: `<script>"&"</script>`},
+			html:   "&lt;script&gt;&#34;&amp;&#34;&lt;/script&gt;",
+		},
+		{
+			name:   "styles",
+			drafty: Drafty{Txt: "bold italic", Fmt: []DraftyStyle{{At: 0, Len: 4, Tp: "ST"}, {At: 5, Len: 6, Tp: "EM"}}},
+			html:   "<b>bold</b> <i>italic</i>",
+		},
+		{
+			name:   "nested styles",
+			drafty: Drafty{Txt: "abcdef", Fmt: []DraftyStyle{{At: 2, Len: 2, Tp: "EM"}, {At: 0, Len: 6, Tp: "ST"}}},
+			html:   "<b>ab<i>cd</i>ef</b>",
+		},
+		{
+			name:   "styles starting together",
+			drafty: Drafty{Txt: "abcdef", Fmt: []DraftyStyle{{At: 0, Len: 3, Tp: "ST"}, {At: 0, Len: 6, Tp: "EM"}}},
+			html:   "<i><b>abc</b>def</i>",
+		},
+		{
+			name:   "overlapping styles are cut",
+			drafty: Drafty{Txt: "abcdef", Fmt: []DraftyStyle{{At: 0, Len: 4, Tp: "ST"}, {At: 2, Len: 4, Tp: "EM"}}},
+			html:   "<b>ab<i>cd</i></b>ef",
+		},
+		{
+			name:   "zero-length style",
+			drafty: Drafty{Txt: "abc", Fmt: []DraftyStyle{{At: 1, Len: 0, Tp: "ST"}}},
+			html:   "a<b></b>bc",
+		},
+		{
+			name:   "style past the end is cut",
+			drafty: Drafty{Txt: "abc", Fmt: []DraftyStyle{{At: 1, Len: 10, Tp: "ST"}}},
+			html:   "a<b>bc</b>",
+		},
+		{
+			name:   "style out of range is skipped",
+			drafty: Drafty{Txt: "abc", Fmt: []DraftyStyle{{At: 4, Len: 1, Tp: "ST"}, {At: 1, Len: -1, Tp: "EM"}}},
+			html:   "abc",
+		},
+		{
+			name:   "unknown style keeps the text",
+			drafty: Drafty{Txt: "abc", Fmt: []DraftyStyle{{At: 0, Len: 3, Tp: "XX"}}},
+			html:   "abc",
+		},
+		{
+			name:   "hidden text",
+			drafty: Drafty{Txt: "abc", Fmt: []DraftyStyle{{At: 1, Len: 1, Tp: "HD"}}},
+			html:   "ac",
+		},
+		{
+			name:   "line breaks",
+			drafty: Drafty{Txt: "a b c", Fmt: []DraftyStyle{{At: 1, Len: 1, Tp: "BR"}, {At: 3, Len: 1, Tp: "BR"}}},
+			html:   "a<br>b<br>c",
+		},
+		{
+			name:   "line break in styled text",
+			drafty: Drafty{Txt: "a b", Fmt: []DraftyStyle{{At: 0, Len: 3, Tp: "ST"}, {At: 1, Len: 1, Tp: "BR"}}},
+			html:   "<b>a<br>b</b>",
+		},
+		{
+			name:   "multi-byte text",
+			drafty: Drafty{Txt: "привет мир 👋 ok", Fmt: []DraftyStyle{{At: 7, Len: 3, Tp: "ST"}, {At: 13, Len: 2, Tp: "EM"}}},
+			html:   "привет <b>мир</b> 👋 <i>ok</i>",
+		},
+		{
+			name:   "link",
+			drafty: Drafty{Txt: "site", Fmt: []DraftyStyle{{At: 0, Len: 4}}, Ent: []DraftyEntity{link(`https://example.com/?a=1&b="2"`)}},
+			html:   `<a href="https://example.com/?a=1&amp;b=&#34;2&#34;" rel="nofollow noopener" target="_blank">site</a>`,
+		},
+		{
+			name:   "javascript link",
+			drafty: Drafty{Txt: "x", Fmt: []DraftyStyle{{At: 0, Len: 1}}, Ent: []DraftyEntity{link("javascript:alert(1)")}},
+			html:   "x",
+		},
+		{
+			name:   "data link",
+			drafty: Drafty{Txt: "x", Fmt: []DraftyStyle{{At: 0, Len: 1}}, Ent: []DraftyEntity{link("data:text/html,<script>alert(1)</script>")}},
+			html:   "x",
+		},
+		{
+			name:   "protocol-relative link",
+			drafty: Drafty{Txt: "x", Fmt: []DraftyStyle{{At: 0, Len: 1}}, Ent: []DraftyEntity{link("//evil.example.com")}},
+			html:   "x",
+		},
+		{
+			name:   "entity key out of range",
+			drafty: Drafty{Txt: "x", Fmt: []DraftyStyle{{At: 0, Len: 1, Key: 1}}, Ent: []DraftyEntity{link("https://example.com")}},
+			html:   "x",
+		},
+		{
+			name: "mention",
+			drafty: Drafty{Txt: "@bob", Fmt: []DraftyStyle{{At: 0, Len: 4}}, Ent: []DraftyEntity{
+				{Tp: "MN", Data: map[string]any{"val": `usr"><x`}},
+			}},
+			html: `<span class="mention" data-user="usr&#34;&gt;&lt;x">@bob</span>`,
+		},
+		{
+			name: "image replaces its text",
+			drafty: Drafty{Txt: " ", Fmt: []DraftyStyle{{At: 0, Len: 1}}, Ent: []DraftyEntity{
+				{Tp: "IM", Data: map[string]any{"ref": "/files/a.png", "name": "a.png"}},
+			}},
+			html: `<img src="/files/a.png" alt="a.png">`,
+		},
+		{
+			name: "attachment after the text",
+			drafty: Drafty{Txt: "see", Fmt: []DraftyStyle{{At: -1, Len: 0}}, Ent: []DraftyEntity{
+				{Tp: "EX", Data: map[string]any{"ref": "/files/a.pdf", "name": "a.pdf"}},
+			}},
+			html: `see<a href="/files/a.pdf" download="a.pdf">a.pdf</a>`,
+		},
+		{
+			name: "attachment with unsafe reference",
+			drafty: Drafty{Txt: "see", Fmt: []DraftyStyle{{At: -1, Len: 0}}, Ent: []DraftyEntity{
+				{Tp: "EX", Data: map[string]any{"ref": "javascript:alert(1)", "name": "a.pdf"}},
+			}},
+			html: "see",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.drafty.HTML(); got != tt.html {
+			t.Errorf("%s: HTML() = %q, want %q", tt.name, got, tt.html)
+		}
+	}
+}
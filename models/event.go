@@ -0,0 +1,35 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Event types pushed to realtime clients
+const (
+	EventData  = "data"  // new message in a topic
+	EventPres  = "pres"  // presence change (user online/offline, topic updated, etc.)
+	EventInfo  = "info"  // notification (read/recv receipts, key presses)
+	EventGap   = "gap"   // too many messages were missed to replay, history must be refetched
+	EventClose = "close" // the session has ended (what: "expired" or "revoked"), the client must log in again
+)
+
+// Event represents a single realtime update forwarded from Tinode to connected clients
+type Event struct {
+	Type      string                     `json:"type"`
+	Topic     string                     `json:"topic"`
+	From      string                     `json:"from,omitempty"`
+	Src       string                     `json:"src,omitempty"`
+	What      string                     `json:"what,omitempty"`
+	SeqID     int32                      `json:"seq_id,omitempty"`
+	Head      map[string]json.RawMessage `json:"head,omitempty"` // e.g. {"replace": ":12"} for edited messages
+	Content   json.RawMessage            `json:"content,omitempty"`
+	DelSeq    []SeqRange                 `json:"del_seq,omitempty"` // Ranges of deleted messages, for "del" presence events
+	Timestamp *time.Time                 `json:"timestamp,omitempty"`
+}
+
+// SeqRange is a range of message seq IDs, Hi is exclusive and zero for a single message
+type SeqRange struct {
+	Low int32 `json:"low"`
+	Hi  int32 `json:"hi,omitempty"`
+}
@@ -0,0 +1,8 @@
+package models
+
+// TinodeHealth describes the state of the connections to the Tinode server
+type TinodeHealth struct {
+	State        string `json:"state"`        // State of the service's own session
+	Sessions     int    `json:"sessions"`     // Number of open user sessions
+	Reconnecting int    `json:"reconnecting"` // Number of user sessions currently reconnecting
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// bareURLPattern matches links written without Markdown markup
+var bareURLPattern = regexp.MustCompile(`^https?://[^\s<>]+`)
+
+// markdownParser converts Markdown inline markup to Drafty styles, entities are shared by all lines
+type markdownParser struct {
+	ent []DraftyEntity
+}
+
+// ParseMarkdown converts text with Markdown inline markup into message content:
+// **bold**, *italic*, ~~strikethrough~~, `code`, [links](https://...) and bare URLs.
+// Text without styles is kept as a plain string. Drafty positions are counted in runes.
+func ParseMarkdown(src string) Content {
+	var p markdownParser
+	var txt []rune
+	var styles []DraftyStyle
+	var lines []string
+	marked := false
+
+	for i, line := range strings.Split(src, "\n") {
+		// lines are joined with a space styled as a line break, the same way Tinode clients do it
+		if i > 0 {
+			styles = append(styles, DraftyStyle{At: len(txt), Len: 1, Tp: "BR"})
+			txt = append(txt, ' ')
+		}
+
+		lineTxt, lineStyles := p.inline([]rune(line))
+		styles = append(styles, shiftStyles(lineStyles, len(txt))...)
+		txt = append(txt, lineTxt...)
+		lines = append(lines, string(lineTxt))
+		marked = marked || len(lineStyles) > 0
+	}
+
+	if !marked {
+		// escapes are the only markup left
+		return Content{Text: strings.Join(lines, "\n")}
+	}
+	return Content{Drafty: &Drafty{Txt: string(txt), Fmt: styles, Ent: p.ent}}
+}
+
+// shiftStyles moves the styles by offset runes
+func shiftStyles(styles []DraftyStyle, offset int) []DraftyStyle {
+	for i := range styles {
+		styles[i].At += offset
+	}
+	return styles
+}
+
+// entity adds an entity and returns its key
+func (p *markdownParser) entity(tp string, data map[string]any) int {
+	p.ent = append(p.ent, DraftyEntity{Tp: tp, Data: data})
+	return len(p.ent) - 1
+}
+
+// inline converts a single line, returning its text without markup and the styles of the text
+func (p *markdownParser) inline(src []rune) ([]rune, []DraftyStyle) {
+	var out []rune
+	var styles []DraftyStyle
+
+	// span styles the text of inner markup, which may be styled itself
+	span := func(inner []rune, style DraftyStyle) {
+		innerTxt, innerStyles := p.inline(inner)
+		style.At, style.Len = len(out), len(innerTxt)
+		styles = append(styles, style)
+		styles = append(styles, shiftStyles(innerStyles, len(out))...)
+		out = append(out, innerTxt...)
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\\' && i+1 < len(src) && (unicode.IsPunct(src[i+1]) || unicode.IsSymbol(src[i+1])):
+			// escaped markup is kept as text
+			out = append(out, src[i+1])
+			i += 2
+			continue
+		case c == '`':
+			// code is not parsed any further
+			if end := indexRune(src, i+1, '`'); end > i+1 {
+				styles = append(styles, DraftyStyle{At: len(out), Len: end - i - 1, Tp: "CO"})
+				out = append(out, src[i+1:end]...)
+				i = end + 1
+				continue
+			}
+		case c == '[':
+			if text, url, next, ok := markdownLink(src, i); ok {
+				span(text, DraftyStyle{Key: p.entity("LN", map[string]any{"url": url})})
+				i = next
+				continue
+			}
+		case c == 'h' && (i == 0 || !isWordRune(src[i-1])):
+			if url := bareURL(src[i:]); url != "" {
+				n := len([]rune(url))
+				styles = append(styles, DraftyStyle{At: len(out), Len: n, Key: p.entity("LN", map[string]any{"url": url})})
+				out = append(out, src[i:i+n]...)
+				i += n
+				continue
+			}
+		case c == '*' || c == '_' || c == '~':
+			if tp, n, end, ok := emphasis(src, i); ok {
+				span(src[i+n:end], DraftyStyle{Tp: tp})
+				i = end + n
+				continue
+			}
+		}
+
+		out = append(out, c)
+		i++
+	}
+	return out, styles
+}
+
+// emphasis finds the emphasis opened at src[i], returning its Drafty style,
+// the length of its delimiter and the position of the closing delimiter
+func emphasis(src []rune, i int) (tp string, n, end int, ok bool) {
+	delim := src[i]
+	n = 1
+	if i+1 < len(src) && src[i+1] == delim {
+		n = 2
+	}
+	switch {
+	case delim == '~' && n == 2:
+		tp = "DL"
+	case delim == '~':
+		return "", 0, 0, false
+	case n == 2:
+		tp = "ST"
+	default:
+		tp = "EM"
+	}
+
+	// emphasis must not start with a space, underscores must not be inside words as in snake_case
+	if i+n >= len(src) || unicode.IsSpace(src[i+n]) || (delim == '_' && i > 0 && isWordRune(src[i-1])) {
+		return "", 0, 0, false
+	}
+
+	for j := i + n + 1; j+n <= len(src); j++ {
+		if src[j] != delim {
+			continue
+		}
+		run := 1
+		for j+run < len(src) && src[j+run] == delim {
+			run++
+		}
+		// a single delimiter does not close at a double one, which belongs to nested emphasis
+		if run == n || (n == 2 && run > 2) {
+			after := j + n
+			if !unicode.IsSpace(src[j-1]) && (delim != '_' || after >= len(src) || !isWordRune(src[after])) {
+				return tp, n, j, true
+			}
+		}
+		j += run - 1
+	}
+	return "", 0, 0, false
+}
+
+// markdownLink parses a [text](url) link opened at src[i], only safe URLs are accepted
+func markdownLink(src []rune, i int) (text []rune, url string, next int, ok bool) {
+	closeText := indexRune(src, i+1, ']')
+	if closeText <= i+1 || closeText+1 >= len(src) || src[closeText+1] != '(' {
+		return nil, "", 0, false
+	}
+	closeURL := indexRune(src, closeText+2, ')')
+	if closeURL < 0 {
+		return nil, "", 0, false
+	}
+
+	url = strings.TrimSpace(string(src[closeText+2 : closeURL]))
+	if !SafeURL(url) {
+		return nil, "", 0, false
+	}
+	return src[i+1 : closeText], url, closeURL + 1, true
+}
+
+// bareURL returns the http(s) URL at the start of src, trailing punctuation is not a part of it
+func bareURL(src []rune) string {
+	// URLs are limited by whitespace, so only the current word is matched
+	end := 0
+	for end < len(src) && !unicode.IsSpace(src[end]) {
+		end++
+	}
+	url := strings.TrimRight(bareURLPattern.FindString(string(src[:end])), ".,:;!?'\")")
+	if !SafeURL(url) {
+		return ""
+	}
+	return url
+}
+
+// indexRune returns the position of the first r in src at or after from, or -1
+func indexRune(src []rune, from int, r rune) int {
+	for i := from; i < len(src); i++ {
+		if src[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// isWordRune reports whether r is a part of a word
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
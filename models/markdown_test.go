@@ -0,0 +1,125 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMarkdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		plain bool // whether the content is kept as a plain string
+		html  string
+	}{
+		{name: "plain", src: "hello world", plain: true, html: "hello world"},
+		{name: "bold and italic", src: "**bold** and *italic* and _italic_", html: "<b>bold</b> and <i>italic</i> and <i>italic</i>"},
+		{name: "strikethrough", src: "~~gone~~ ~kept~", html: "<s>gone</s> ~kept~"},
+		{name: "code", src: "run `a *b* c`", html: "run <code>a *b* c</code>"},
+		{name: "nested emphasis", src: "**bold *italic* bold**", html: "<b>bold <i>italic</i> bold</b>"},
+		{name: "nested in italic", src: "*a **b** c*", html: "<i>a <b>b</b> c</i>"},
+		{name: "emphasis in strikethrough", src: "~~a **b**~~", html: "<s>a <b>b</b></s>"},
+		{name: "unclosed bold", src: "**bold", plain: true, html: "**bold"},
+		{name: "unclosed italic", src: "*italic", plain: true, html: "*italic"},
+		{name: "unclosed code", src: "`code", plain: true, html: "`code"},
+		{name: "unclosed inside closed", src: "**a *b**", html: "<b>a *b</b>"},
+		{name: "spaces around delimiters", src: "2 * 3 * 4", plain: true, html: "2 * 3 * 4"},
+		{name: "snake case", src: "snake_case_name", plain: true, html: "snake_case_name"},
+		{name: "empty emphasis", src: "****", plain: true, html: "****"},
+		{name: "escaped emphasis", src: `\*not italic\*`, plain: true, html: "*not italic*"},
+		{name: "escaped backslash", src: `a\\b`, plain: true, html: `a\b`},
+		{name: "backslash before letter", src: `a\b`, plain: true, html: `a\b`},
+		{name: "escape inside emphasis", src: `**a\*b**`, html: "<b>a*b</b>"},
+		{name: "escaped link", src: `\[a](/files/a.png)`, plain: true, html: "[a](/files/a.png)"},
+		{name: "escaped link with bare url", src: `\[a](https://example.com)`, html: `[a](<a href="https://example.com" rel="nofollow noopener" target="_blank">https://example.com</a>)`},
+		{name: "link", src: "[site](https://example.com)", html: `<a href="https://example.com" rel="nofollow noopener" target="_blank">site</a>`},
+		{name: "link with styled text", src: "[**site**](https://example.com)", html: `<a href="https://example.com" rel="nofollow noopener" target="_blank"><b>site</b></a>`},
+		{name: "relative link", src: "[file](/files/a.png)", html: `<a href="/files/a.png" rel="nofollow noopener" target="_blank">file</a>`},
+		{name: "mailto link", src: "[mail](mailto:a@example.com)", html: `<a href="mailto:a@example.com" rel="nofollow noopener" target="_blank">mail</a>`},
+		{name: "javascript link", src: "[x](javascript:alert(1))", plain: true, html: "[x](javascript:alert(1))"},
+		{name: "javascript link with mixed case", src: "[x](JavaScript:alert(1))", plain: true, html: "[x](JavaScript:alert(1))"},
+		{name: "data link", src: "[x](data:text/html,<script>alert(1)</script>)", plain: true, html: "[x](data:text/html,&lt;script&gt;alert(1)&lt;/script&gt;)"},
+		{name: "protocol-relative link", src: "[x](//evil.example.com)", plain: true, html: "[x](//evil.example.com)"},
+		{name: "link without host", src: "[x](https:///path)", plain: true, html: "[x](https:///path)"},
+		{name: "bare url", src: "see https://example.com/a?b=1&c=2", html: `see <a href="https://example.com/a?b=1&amp;c=2" rel="nofollow noopener" target="_blank">https://example.com/a?b=1&amp;c=2</a>`},
+		{name: "bare url with trailing period", src: "see https://example.com.", html: `see <a href="https://example.com" rel="nofollow noopener" target="_blank">https://example.com</a>.`},
+		{name: "bare url with trailing punctuation", src: "(https://example.com/x)!?", html: `(<a href="https://example.com/x" rel="nofollow noopener" target="_blank">https://example.com/x</a>)!?`},
+		{name: "bare url inside a word", src: "xhttps://example.com", plain: true, html: "xhttps://example.com"},
+		{name: "bare url without host", src: "https:// nothing", plain: true, html: "https:// nothing"},
+		{name: "bare url in emphasis", src: "*https://example.com*", html: `<i><a href="https://example.com" rel="nofollow noopener" target="_blank">https://example.com</a></i>`},
+		{name: "html is escaped", src: "<b>**x**</b>", html: "&lt;b&gt;<b>x</b>&lt;/b&gt;"},
+		{name: "multi-byte text", src: "привет **мир** 👋 *ok*", html: "привет <b>мир</b> 👋 <i>ok</i>"},
+		{name: "line breaks", src: "a\nb", plain: true, html: "a<br>b"},
+		{name: "line breaks with styles", src: "**a**\n\nb", html: "<b>a</b><br><br>b"},
+		{name: "emphasis does not span lines", src: "*a\nb*", plain: true, html: "*a<br>b*"},
+	}
+
+	for _, tt := range tests {
+		content := ParseMarkdown(tt.src)
+		if plain := content.Drafty == nil; plain != tt.plain {
+			t.Errorf("%s: ParseMarkdown(%q) plain = %v, want %v", tt.name, tt.src, plain, tt.plain)
+		}
+		if got := content.HTML(); got != tt.html {
+			t.Errorf("%s: ParseMarkdown(%q).HTML() = %q, want %q", tt.name, tt.src, got, tt.html)
+		}
+	}
+}
+
+func TestParseMarkdownPositions(t *testing.T) {
+	tests := []struct {
+		src  string
+		want Drafty
+		text string // text with line breaks restored
+	}{
+		{
+			// positions are counted in runes, not bytes
+			src: "привет **мир** 👋 *ok*",
+			want: Drafty{Txt: "привет мир 👋 ok", Fmt: []DraftyStyle{
+				{At: 7, Len: 3, Tp: "ST"},
+				{At: 13, Len: 2, Tp: "EM"},
+			}},
+			text: "привет мир 👋 ok",
+		},
+		{
+			// lines are joined with a space styled as a line break
+			src: "**a**\nb *c*",
+			want: Drafty{Txt: "a b c", Fmt: []DraftyStyle{
+				{At: 0, Len: 1, Tp: "ST"},
+				{At: 1, Len: 1, Tp: "BR"},
+				{At: 4, Len: 1, Tp: "EM"},
+			}},
+			text: "a\nb c",
+		},
+		{
+			// entities of every line are kept in one list
+			src: "[a](https://a.example.com)\nhttps://b.example.com",
+			want: Drafty{
+				Txt: "a https://b.example.com",
+				Fmt: []DraftyStyle{
+					{At: 0, Len: 1, Key: 0},
+					{At: 1, Len: 1, Tp: "BR"},
+					{At: 2, Len: 21, Key: 1},
+				},
+				Ent: []DraftyEntity{
+					{Tp: "LN", Data: map[string]any{"url": "https://a.example.com"}},
+					{Tp: "LN", Data: map[string]any{"url": "https://b.example.com"}},
+				},
+			},
+			text: "a\nhttps://b.example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		content := ParseMarkdown(tt.src)
+		if content.Drafty == nil {
+			t.Errorf("ParseMarkdown(%q) = plain text %q, want Drafty", tt.src, content.Text)
+			continue
+		}
+		if !reflect.DeepEqual(*content.Drafty, tt.want) {
+			t.Errorf("ParseMarkdown(%q) = %+v, want %+v", tt.src, *content.Drafty, tt.want)
+		}
+		if got := content.PlainText(); got != tt.text {
+			t.Errorf("ParseMarkdown(%q).PlainText() = %q, want %q", tt.src, got, tt.text)
+		}
+	}
+}
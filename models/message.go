@@ -3,7 +3,57 @@ package models
 import "time"
 
 type Message struct {
-	Author    string    `json:"author" bson:"from"`
-	Text      string    `json:"text" bson:"content"`
-	Timestamp time.Time `json:"timestamp" bson:"createdat"`
+	ID          string              `json:"id" bson:"_id"`
+	SeqID       int32               `json:"seq_id" bson:"seqid"`
+	Topic       string              `json:"-" bson:"topic"`
+	Author      string              `json:"author" bson:"from"`
+	Head        map[string]any      `json:"-" bson:"head,omitempty"`
+	Content     Content             `json:"content" bson:"content"` // Plain string or Drafty document
+	Text        string              `json:"text" bson:"-"`          // Plain text of the content
+	HTML        string              `json:"html" bson:"-"`          // Content rendered as HTML
+	Attachments []Attachment        `json:"attachments,omitempty" bson:"-"`
+	Replies     int32               `json:"replies,omitempty" bson:"-"`       // Number of replies in the thread of the message
+	LastReplyAt *time.Time          `json:"last_reply_at,omitempty" bson:"-"` // Time of the latest reply, nil without replies
+	Reactions   map[string][]string `json:"reactions,omitempty" bson:"-"`     // Emoji to the users who reacted with it
+	Timestamp   time.Time           `json:"timestamp" bson:"createdat"`
+	EditedAt    *time.Time          `json:"edited_at,omitempty" bson:"-"` // Time of the latest edit, nil if the message was never edited
+}
+
+// Attachment describes a file attached to a message
+type Attachment struct {
+	Name string `json:"name,omitempty"`
+	MIME string `json:"mime"`
+	Size int64  `json:"size"`
+	URL  string `json:"url"`
+}
+
+// MessagePage is a page of message history, ordered from newest to oldest.
+// NextCursor is passed as `before` to fetch older messages, PrevCursor as `after` to fetch newer ones.
+// A nil cursor means there is nothing more in that direction.
+type MessagePage struct {
+	Messages   []Message `json:"messages"`
+	NextCursor *int32    `json:"next_cursor"`
+	PrevCursor *int32    `json:"prev_cursor"`
+}
+
+// Thread is a message with a page of replies to it
+type Thread struct {
+	Root Message `json:"root"`
+	MessagePage
+}
+
+// SearchResult is a message matching a search query
+// Topic is the group topic of the message, or the other user for direct messages
+// Snippet is the HTML-escaped text around the first match, matching words are wrapped in <mark>
+type SearchResult struct {
+	Topic   string  `json:"topic"`
+	Message Message `json:"message"`
+	Snippet string  `json:"snippet"`
+}
+
+// SearchPage is a page of search results, ordered from newest to oldest.
+// NextCursor is passed as `cursor` to fetch older results, nil if there are none.
+type SearchPage struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor *string        `json:"next_cursor"`
 }
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Scheduled message states
+const (
+	ScheduledPending = "scheduled" // Waiting for the next run
+	ScheduledSending = "sending"   // Claimed by the worker, a one-time message being published
+	ScheduledFailed  = "failed"    // A one-time message that could not be published or a message its author can no longer publish, see LastError
+)
+
+// ScheduledMessage is a message published later on behalf of its author,
+// either once at SendAt or repeatedly on the schedule of the Cron expression
+type ScheduledMessage struct {
+	ID        string     `json:"id" bson:"_id"`
+	Author    UserID     `json:"author" bson:"user"`
+	Topic     string     `json:"topic" bson:"topic"` // Group topic, or the other user for direct messages
+	TopicID   string     `json:"-" bson:"topic_id"`  // ID the topic is stored under
+	Content   Content    `json:"content" bson:"content"`
+	ReplyTo   int32      `json:"reply_to,omitempty" bson:"reply_to,omitempty"`
+	SendAt    *time.Time `json:"send_at,omitempty" bson:"send_at,omitempty"`
+	Cron      string     `json:"cron,omitempty" bson:"cron,omitempty"`
+	Status    string     `json:"status" bson:"status"`
+	NextRunAt time.Time  `json:"next_run_at" bson:"next_run_at"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty" bson:"last_run_at,omitempty"`
+	LastError string     `json:"last_error,omitempty" bson:"last_error,omitempty"` // Why the latest run failed
+	ClaimedAt *time.Time `json:"-" bson:"claimed_at,omitempty"`                    // When a one-time message was claimed for sending
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+}
@@ -1,6 +1,95 @@
 package models
 
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
 type Topic struct {
-	ID   string
-	Name string
+	ID          string      `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Owner       UserID      `json:"owner,omitempty"`
+	Access      TopicAccess `json:"access"`
+	Mode        string      `json:"mode,omitempty"` // Access mode of the requesting user, e.g. "JRWPASDO" for the owner
+	Pins        []int32     `json:"pins,omitempty"` // Seq IDs of the pinned messages, the latest pin first
+}
+
+// TopicAccess is the default access mode of a topic, e.g. "JRWPA" for authenticated and "N" for anonymous users
+type TopicAccess struct {
+	Auth string `json:"auth"`
+	Anon string `json:"anon"`
+}
+
+// ParseGroupTopicID validates a Tinode group topic ID: "grp" prefix followed by a base64 encoded 64-bit integer
+func ParseGroupTopicID(id string) (string, error) {
+	raw, ok := strings.CutPrefix(id, "grp")
+	if !ok {
+		return "", errors.New("invalid topic id prefix")
+	}
+
+	tid, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return "", err
+	}
+	if len(tid) != 8 {
+		return "", errors.New("invalid topic id length")
+	}
+
+	return id, nil
+}
+
+// P2PTopicID returns the ID Tinode stores the peer-to-peer topic of two users under.
+// Clients address the topic by the ID of the other user, the stored ID concatenates both
+// user IDs, the smaller first, e.g. p2pAbCdEfGhIjKLmNoPqRsTuV
+func P2PTopicID(a, b UserID) (string, error) {
+	ua, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(string(a), "usr"))
+	if err != nil {
+		return "", err
+	}
+	ub, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(string(b), "usr"))
+	if err != nil {
+		return "", err
+	}
+	if len(ua) != 8 || len(ub) != 8 {
+		return "", errors.New("invalid user id length")
+	}
+	if bytes.Equal(ua, ub) {
+		return "", errors.New("peer-to-peer topic requires two different users")
+	}
+
+	// user IDs are little endian encoded 64-bit integers, ordered by their numeric value
+	if binary.LittleEndian.Uint64(ua) > binary.LittleEndian.Uint64(ub) {
+		ua, ub = ub, ua
+	}
+	return "p2p" + base64.RawURLEncoding.EncodeToString(append(ua, ub...)), nil
+}
+
+// P2PPeer returns the other user of the stored peer-to-peer topic, i.e. the ID clients of the user address it by
+func P2PPeer(topicID string, user UserID) (UserID, error) {
+	raw, ok := strings.CutPrefix(topicID, "p2p")
+	if !ok {
+		return "", errors.New("invalid topic id prefix")
+	}
+	ids, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return "", err
+	}
+	if len(ids) != 16 {
+		return "", errors.New("invalid topic id length")
+	}
+
+	a := UserID("usr" + base64.RawURLEncoding.EncodeToString(ids[:8]))
+	b := UserID("usr" + base64.RawURLEncoding.EncodeToString(ids[8:]))
+	switch user {
+	case a:
+		return b, nil
+	case b:
+		return a, nil
+	default:
+		return "", errors.New("user is not a party of the topic")
+	}
 }
@@ -1,7 +1,9 @@
 package models
 
 import (
-	"go.mongodb.org/mongo-driver/v2/bson"
+	"encoding/base64"
+	"errors"
+	"strings"
 )
 
 type User struct {
@@ -11,15 +13,25 @@ type User struct {
 	Password string `json:"-"`
 }
 
+// UserID is a Tinode user ID, e.g. usrAbCdEfGhIjK
 type UserID string
 
+// ParseUserID validates a Tinode user ID: "usr" prefix followed by a base64 encoded 64-bit integer
 func ParseUserID(id string) (UserID, error) {
-	uid, err := bson.ObjectIDFromHex(id)
+	raw, ok := strings.CutPrefix(id, "usr")
+	if !ok {
+		return "", errors.New("invalid user id prefix")
+	}
+
+	uid, err := base64.RawURLEncoding.DecodeString(raw)
 	if err != nil {
 		return "", err
 	}
+	if len(uid) != 8 {
+		return "", errors.New("invalid user id length")
+	}
 
-	return UserID(uid.Hex()), nil
+	return UserID(id), nil
 }
 
 func (id UserID) String() string {
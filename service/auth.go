@@ -1,13 +1,17 @@
 package service
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
-	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/dartt0n/realtime-chat-backend/keyring"
 	"github.com/dartt0n/realtime-chat-backend/kv"
 	"github.com/dartt0n/realtime-chat-backend/models"
 	jwt "github.com/golang-jwt/jwt/v4"
@@ -16,35 +20,107 @@ import (
 
 // AuthService handles authentication related operations using a key-value store
 type AuthService struct {
-	kv kv.KeyValueStore
+	kv      kv.KeyValueStore
+	keys    *keyring.Keyring // Keys tokens are signed and verified with
+	revokes *revokeHooks     // Callbacks notified of revoked access tokens
 }
 
-// NewAuthService creates a new AuthService instance with the provided key-value store
-func NewAuthService(kv kv.KeyValueStore) *AuthService {
+// revokeHooks holds the callbacks notified of revoked access tokens
+type revokeHooks struct {
+	mu  sync.RWMutex
+	fns []func(accessUUID string)
+}
+
+const (
+	accessTTL  = 15 * time.Minute
+	refreshTTL = 3 * 24 * time.Hour
+)
+
+// tokenFamily is the chain of token pairs issued from a single login, i.e. a session of the user.
+// Only the latest pair is valid, the family is stored under familyKey and expires with its latest refresh token.
+type tokenFamily struct {
+	UserID      models.UserID `json:"user_id"`
+	AccessUUID  string        `json:"access_uuid"`
+	RefreshUUID string        `json:"refresh_uuid"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UserAgent   string        `json:"user_agent"`
+	IP          string        `json:"ip"`
+}
+
+// Values of the "typ" claim, access and refresh tokens are signed with the same keys
+const (
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+)
+
+// NewAuthService creates a new AuthService instance with the provided key-value store and keyring
+func NewAuthService(kv kv.KeyValueStore, keys *keyring.Keyring) *AuthService {
 	return &AuthService{
-		kv: kv,
+		kv:      kv,
+		keys:    keys,
+		revokes: &revokeHooks{},
+	}
+}
+
+// OnRevoke registers a callback notified when an access token is revoked before its expiration,
+// e.g. to close resources opened on its behalf
+func (s AuthService) OnRevoke(fn func(accessUUID string)) {
+	s.revokes.mu.Lock()
+	defer s.revokes.mu.Unlock()
+
+	s.revokes.fns = append(s.revokes.fns, fn)
+}
+
+// notifyRevoke passes the revoked access UUID to the registered callbacks
+func (s AuthService) notifyRevoke(accessUUID string) {
+	s.revokes.mu.RLock()
+	defer s.revokes.mu.RUnlock()
+
+	for _, fn := range s.revokes.fns {
+		fn(accessUUID)
 	}
 }
 
+// familyKey returns the key the token family is stored under
+func familyKey(familyID string) string {
+	return "family:" + familyID
+}
+
+// lastUsedKey returns the key of the Unix time the token family was last used at
+func lastUsedKey(familyID string) string {
+	return "family:" + familyID + ":used"
+}
+
+// sessionsKey returns the key of the set of the user's token families
+func sessionsKey(userID models.UserID) string {
+	return "sessions:" + userID.String()
+}
+
 // CreateToken generates access and refresh tokens for a given user ID
-func (s AuthService) CreateToken(userID models.UserID) (*models.TokenDetails, error) {
-	td := &models.TokenDetails{}
-	td.AtExpires = time.Now().Add(time.Minute * 15).Unix() // 15 minutes
+// familyID: family the pair belongs to, empty starts a new family
+func (s AuthService) CreateToken(userID models.UserID, familyID string) (*models.TokenDetails, error) {
+	if familyID == "" {
+		familyID = uuid.New().String()
+	}
+
+	td := &models.TokenDetails{FamilyID: familyID}
+	td.AtExpires = time.Now().Add(accessTTL).Unix()
 	td.AccessUUID = uuid.New().String()
 
-	td.RtExpires = time.Now().Add(time.Hour * 24 * 3).Unix() // 3 days
+	td.RtExpires = time.Now().Add(refreshTTL).Unix()
 	td.RefreshUUID = uuid.New().String()
 
 	var err error
 	//Creating Access Token
 	atClaims := jwt.MapClaims{}
 	atClaims["authorized"] = true
+	atClaims["typ"] = tokenTypeAccess
 	atClaims["access_uuid"] = td.AccessUUID
+	atClaims["family_id"] = td.FamilyID
 	atClaims["user_id"] = userID
 	atClaims["exp"] = td.AtExpires
 
-	at := jwt.NewWithClaims(jwt.SigningMethodHS256, atClaims)
-	td.AccessToken, err = at.SignedString([]byte(os.Getenv("ACCESS_SECRET")))
+	td.AccessToken, err = s.keys.Sign(atClaims)
 	if err != nil {
 		slog.Error("failed to create access token", "error", err, "user_id", userID)
 		return nil, err
@@ -52,11 +128,12 @@ func (s AuthService) CreateToken(userID models.UserID) (*models.TokenDetails, er
 
 	//Creating Refresh Token
 	rtClaims := jwt.MapClaims{}
+	rtClaims["typ"] = tokenTypeRefresh
 	rtClaims["refresh_uuid"] = td.RefreshUUID
+	rtClaims["family_id"] = td.FamilyID
 	rtClaims["user_id"] = userID.String()
 	rtClaims["exp"] = td.RtExpires
-	rt := jwt.NewWithClaims(jwt.SigningMethodHS256, rtClaims)
-	td.RefreshToken, err = rt.SignedString([]byte(os.Getenv("REFRESH_SECRET")))
+	td.RefreshToken, err = s.keys.Sign(rtClaims)
 	if err != nil {
 		slog.Error("failed to create refresh token", "error", err, "user_id", userID)
 		return nil, err
@@ -64,8 +141,32 @@ func (s AuthService) CreateToken(userID models.UserID) (*models.TokenDetails, er
 	return td, nil
 }
 
-// CreateAuth stores the token details in the key-value store with appropriate expiration times
-func (s AuthService) CreateAuth(userID models.UserID, td *models.TokenDetails) (err error) {
+// CreateAuth stores the token details of a new login in the key-value store with appropriate expiration times,
+// along with the session started by the login
+func (s AuthService) CreateAuth(userID models.UserID, td *models.TokenDetails, client models.ClientInfo) error {
+	if err := s.storeTokens(userID, td); err != nil {
+		return err
+	}
+
+	family := tokenFamily{
+		UserID:    userID,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		UserAgent: client.UserAgent,
+		IP:        client.IP,
+	}
+	if err := s.storeFamily(td, family); err != nil {
+		return err
+	}
+
+	if err := s.kv.SAdd(sessionsKey(userID), td.FamilyID); err != nil {
+		slog.Error("failed to index session", "error", err, "user_id", userID, "family_id", td.FamilyID)
+		return err
+	}
+	return nil
+}
+
+// storeTokens stores the access and refresh UUIDs of the pair until the tokens expire
+func (s AuthService) storeTokens(userID models.UserID, td *models.TokenDetails) (err error) {
 	at := time.Unix(td.AtExpires, 0) //converting Unix to UTC(to Time object)
 	rt := time.Unix(td.RtExpires, 0)
 	now := time.Now()
@@ -84,6 +185,192 @@ func (s AuthService) CreateAuth(userID models.UserID, td *models.TokenDetails) (
 	return nil
 }
 
+// storeFamily stores the family with the pair as its latest one, until the refresh token of the pair expires
+func (s AuthService) storeFamily(td *models.TokenDetails, family tokenFamily) error {
+	family.AccessUUID = td.AccessUUID
+	family.RefreshUUID = td.RefreshUUID
+
+	raw, err := json.Marshal(family)
+	if err != nil {
+		return err
+	}
+	err = s.kv.Set(familyKey(td.FamilyID), string(raw), time.Until(time.Unix(td.RtExpires, 0)))
+	if err != nil {
+		slog.Error("failed to store token family", "error", err, "user_id", family.UserID, "family_id", td.FamilyID)
+		return err
+	}
+	return nil
+}
+
+// family returns the token family with the given ID
+func (s AuthService) family(familyID string) (family tokenFamily, err error) {
+	raw, err := s.kv.Get(familyKey(familyID))
+	if err != nil {
+		return family, err
+	}
+	err = json.Unmarshal([]byte(raw), &family)
+	return family, err
+}
+
+// Refresh exchanges a refresh token for a new token pair of the same family.
+// The refresh token and the access token of its pair are invalidated. Reusing a refresh token
+// that was already rotated revokes the whole family and returns ErrTokenReuse.
+func (s AuthService) Refresh(refreshToken string) (*models.TokenDetails, error) {
+	token, err := s.ParseRefreshToken(refreshToken)
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	refreshUUID, _ := claims["refresh_uuid"].(string)
+	familyID, _ := claims["family_id"].(string)
+	rawUserID, _ := claims["user_id"].(string)
+	userID, err := models.ParseUserID(rawUserID)
+	if err != nil || refreshUUID == "" || familyID == "" {
+		return nil, ErrInvalidToken
+	}
+
+	// deletion succeeds only once, so concurrent refreshes with the same token can not both pass
+	if _, err := s.kv.Del(refreshUUID); err != nil {
+		family, famErr := s.family(familyID)
+		if famErr == nil && family.RefreshUUID != refreshUUID {
+			slog.Warn("refresh token reused, revoking token family",
+				"security_event", "refresh_token_reuse", "user_id", userID, "family_id", familyID, "refresh_uuid", refreshUUID)
+			s.RevokeFamily(familyID)
+			return nil, ErrTokenReuse
+		}
+		// expired or revoked along with its family
+		return nil, ErrInvalidToken
+	}
+
+	family, err := s.family(familyID)
+	if err != nil {
+		slog.Error("failed to fetch token family", "error", err, "family_id", familyID)
+		return nil, ErrInvalidToken
+	}
+
+	td, err := s.CreateToken(userID, familyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.storeTokens(userID, td); err != nil {
+		return nil, err
+	}
+	if err := s.storeFamily(td, family); err != nil {
+		return nil, err
+	}
+	// hand the Tinode token over to the new pair, so the user's Tinode session can be reopened
+	if err := s.RotateTinodeToken(refreshUUID, td); err != nil {
+		return nil, err
+	}
+
+	// the access token of the previous pair must not outlive the refresh
+	s.revokeAccess(family.AccessUUID)
+	// a refresh is a use of the session, recording it also extends the record with the family
+	if err := s.TouchSession(td.FamilyID); err != nil {
+		slog.Warn("failed to record session use", "error", err, "family_id", td.FamilyID)
+	}
+	return td, nil
+}
+
+// RevokeFamily invalidates the latest token pair of the family and the family itself,
+// so none of its refresh tokens can be used anymore
+func (s AuthService) RevokeFamily(familyID string) error {
+	family, err := s.family(familyID)
+	if err != nil {
+		return err
+	}
+
+	// tokens may have expired or been rotated already, so missing keys are not errors
+	s.kv.Del(familyKey(familyID))
+	s.kv.Del(lastUsedKey(familyID))
+	s.kv.SRem(sessionsKey(family.UserID), familyID)
+	s.kv.Del(family.RefreshUUID)
+	s.kv.Del(tinodeTokenKey(family.RefreshUUID))
+	s.revokeAccess(family.AccessUUID)
+	return nil
+}
+
+// TouchSession records that the token family was used just now.
+// The record expires with the family and is not written for revoked families or tokens without one.
+func (s AuthService) TouchSession(familyID string) error {
+	if familyID == "" {
+		return nil
+	}
+	_, err := s.kv.SetWith(lastUsedKey(familyID), strconv.FormatInt(time.Now().Unix(), 10), familyKey(familyID))
+	return err
+}
+
+// Sessions returns the active sessions of the user, the most recently used first.
+// currentID is the family of the request's token, its session is marked as current.
+func (s AuthService) Sessions(userID models.UserID, currentID string) ([]models.Session, error) {
+	ids, err := s.kv.SMembers(sessionsKey(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]models.Session, 0, len(ids))
+	for _, id := range ids {
+		family, err := s.family(id)
+		if err != nil {
+			// the family has expired, the index is cleaned up lazily
+			s.kv.SRem(sessionsKey(userID), id)
+			continue
+		}
+
+		session := models.Session{
+			ID:         id,
+			CreatedAt:  family.CreatedAt,
+			LastUsedAt: family.CreatedAt,
+			UserAgent:  family.UserAgent,
+			IP:         family.IP,
+			Current:    id == currentID,
+		}
+		if raw, err := s.kv.Get(lastUsedKey(id)); err == nil {
+			if unix, err := strconv.ParseInt(raw, 10, 64); err == nil {
+				session.LastUsedAt = time.Unix(unix, 0).UTC()
+			}
+		}
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+// RevokeSession revokes a session of the user, returns ErrNotFound if the user has no such session
+func (s AuthService) RevokeSession(userID models.UserID, familyID string) error {
+	family, err := s.family(familyID)
+	if err != nil || family.UserID != userID {
+		return ErrNotFound
+	}
+	return s.RevokeFamily(familyID)
+}
+
+// RevokeSessions revokes all sessions of the user
+func (s AuthService) RevokeSessions(userID models.UserID) error {
+	ids, err := s.kv.SMembers(sessionsKey(userID))
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		// expired families are gone already
+		s.RevokeFamily(id)
+	}
+	s.kv.Del(sessionsKey(userID))
+	return nil
+}
+
+// revokeAccess invalidates the access token and the Tinode token stored for it
+func (s AuthService) revokeAccess(accessUUID string) {
+	s.kv.Del(accessUUID)
+	s.kv.Del(tinodeTokenKey(accessUUID))
+	s.notifyRevoke(accessUUID)
+}
+
 // ExtractToken extracts the token from the Authorization header of an HTTP request
 func (s AuthService) ExtractToken(r *http.Request) string {
 	bearToken := r.Header.Get("Authorization")
@@ -96,24 +383,44 @@ func (s AuthService) ExtractToken(r *http.Request) string {
 	return strArr[0]
 }
 
-// VerifyToken validates the token signature and returns the parsed token
+// ParseToken validates the token signature with the key named by its "kid" and returns the parsed token
+func (s AuthService) ParseToken(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, s.keys.Keyfunc, jwt.WithValidMethods(s.keys.Methods()))
+}
+
+// ParseRefreshToken validates the signature of a refresh token and returns the parsed token,
+// access tokens are rejected with ErrInvalidToken
+func (s AuthService) ParseRefreshToken(tokenString string) (*jwt.Token, error) {
+	token, err := s.ParseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims, ok := token.Claims.(jwt.MapClaims); !ok || claims["typ"] != tokenTypeRefresh {
+		return nil, ErrInvalidToken
+	}
+	return token, nil
+}
+
+// VerifyToken validates the signature of the request's access token and returns the parsed token.
+// Refresh tokens are signed with the same keys, they are told apart by the "typ" claim.
 func (s AuthService) VerifyToken(r *http.Request) (*jwt.Token, error) {
-	tokenString := s.ExtractToken(r)
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		//Make sure that the token method conform to "SigningMethodHMAC"
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			slog.Error("invalid signing method", "method", token.Header["alg"])
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(os.Getenv("ACCESS_SECRET")), nil
-	})
+	token, err := s.ParseToken(s.ExtractToken(r))
 	if err != nil {
 		slog.Error("failed to verify token", "error", err)
 		return nil, err
 	}
+	if claims, ok := token.Claims.(jwt.MapClaims); !ok || claims["typ"] != tokenTypeAccess {
+		slog.Error("token is not an access token")
+		return nil, ErrInvalidToken
+	}
 	return token, nil
 }
 
+// JWKS returns the public keys tokens are verified with
+func (s AuthService) JWKS() keyring.JWKS {
+	return s.keys.JWKS()
+}
+
 // TokenValid checks if the token in the request is valid
 func (s AuthService) TokenValid(r *http.Request) error {
 	token, err := s.VerifyToken(r)
@@ -138,19 +445,25 @@ func (s AuthService) ExtractTokenMetadata(r *http.Request) (*models.AccessDetail
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if ok && token.Valid {
 		accessUUID, ok := claims["access_uuid"].(string)
-		if !ok {
+		if !ok || accessUUID == "" {
 			slog.Error("missing access_uuid in token claims")
-			return nil, err
+			return nil, ErrInvalidToken
+		}
+		userID, ok := claims["user_id"].(string)
+		if !ok {
+			slog.Error("missing user_id in token claims")
+			return nil, ErrInvalidToken
 		}
-		userID := claims["user_id"].(string)
+		familyID, _ := claims["family_id"].(string)
 
 		return &models.AccessDetails{
 			AccessUUID: accessUUID,
+			FamilyID:   familyID,
 			UserID:     userID,
 		}, nil
 	}
 	slog.Error("invalid token or claims")
-	return nil, err
+	return nil, ErrInvalidToken
 }
 
 // FetchAuth retrieves the user ID associated with the given access details from the key-value store
@@ -170,19 +483,66 @@ func (s AuthService) FetchAuth(authD *models.AccessDetails) (userID models.UserI
 	return userID, err
 }
 
-// DeleteAuth removes the authentication data for the given UUID from the key-value store
-func (s AuthService) DeleteAuth(givenUUID string) (userID models.UserID, err error) {
-	rawID, err := s.kv.Del(givenUUID)
+// tinodeTokenKey returns the key under which the Tinode token issued for a JWT UUID is stored
+func tinodeTokenKey(givenUUID string) string {
+	return givenUUID + ":token"
+}
+
+// CreateTinodeToken stores the Tinode token for both access and refresh UUIDs of the token pair,
+// so the token outlives the access token and can be handed over to the refreshed pair
+func (s AuthService) CreateTinodeToken(td *models.TokenDetails, token string) (err error) {
+	at := time.Unix(td.AtExpires, 0)
+	rt := time.Unix(td.RtExpires, 0)
+	now := time.Now()
+
+	err = s.kv.Set(tinodeTokenKey(td.AccessUUID), token, at.Sub(now))
 	if err != nil {
-		slog.Error("failed to delete auth details", "error", err, "uuid", givenUUID)
-		return userID, err
+		slog.Error("failed to store tinode token", "error", err, "access_uuid", td.AccessUUID)
+		return err
 	}
 
-	userID, err = models.ParseUserID(rawID)
+	err = s.kv.Set(tinodeTokenKey(td.RefreshUUID), token, rt.Sub(now))
 	if err != nil {
-		slog.Error("failed to parse user ID during deletion", "error", err, "raw_id", rawID)
-		return userID, err
+		slog.Error("failed to store tinode token", "error", err, "refresh_uuid", td.RefreshUUID)
+		return err
 	}
+	return nil
+}
 
-	return userID, err
+// FetchTinodeToken retrieves the Tinode token associated with the given access UUID.
+// Returns ErrInvalidToken if the token pair has expired or was revoked.
+func (s AuthService) FetchTinodeToken(accessUUID string) (string, error) {
+	token, err := s.kv.Get(tinodeTokenKey(accessUUID))
+	if errors.Is(err, kv.ErrNotFound) {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		slog.Error("failed to fetch tinode token", "error", err, "access_uuid", accessUUID)
+		return "", err
+	}
+	return token, nil
+}
+
+// RotateTinodeToken moves the Tinode token of a refreshed token pair, identified by its refresh UUID, to the new pair
+func (s AuthService) RotateTinodeToken(refreshUUID string, td *models.TokenDetails) error {
+	token, err := s.kv.Get(tinodeTokenKey(refreshUUID))
+	if err != nil {
+		slog.Error("failed to fetch tinode token", "error", err, "refresh_uuid", refreshUUID)
+		return err
+	}
+
+	if err := s.CreateTinodeToken(td, token); err != nil {
+		return err
+	}
+
+	return s.DeleteTinodeToken(refreshUUID)
+}
+
+// DeleteTinodeToken removes the Tinode token associated with the given UUID from the key-value store
+func (s AuthService) DeleteTinodeToken(givenUUID string) error {
+	if _, err := s.kv.Del(tinodeTokenKey(givenUUID)); err != nil {
+		slog.Error("failed to delete tinode token", "error", err, "uuid", givenUUID)
+		return err
+	}
+	return nil
 }
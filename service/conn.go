@@ -0,0 +1,326 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"github.com/google/uuid"
+	"github.com/tinode/chat/pbx"
+)
+
+// requestTimeout is the deadline applied to requests whose context has none
+const requestTimeout = 10 * time.Second
+
+// requester sends a message to the Tinode server and waits for the response to it
+type requester interface {
+	send(ctx context.Context, rID string, msg *pbx.ClientMsg) (res any, err error)
+}
+
+// conn wraps a single Tinode MessageLoop stream.
+// It demultiplexes responses to the requests sent through it and forwards updates to publish.
+type conn struct {
+	stream  pbx.Node_MessageLoopClient
+	cancel  context.CancelFunc
+	publish func(ev models.Event)
+
+	sendMu sync.Mutex // gRPC streams do not support concurrent Send calls
+	reqres *sync.Map  // Maps request IDs to response channels
+
+	done chan struct{} // Closed once the stream is gone
+	err  error         // Reason the stream is gone, set before done is closed
+}
+
+var _ requester = (*conn)(nil)
+
+// dial opens a new stream to the Tinode server and starts listening to it
+// publish: Callback receiving data, presence and info updates
+func dial(client pbx.NodeClient, publish func(ev models.Event)) (*conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.MessageLoop(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	c := &conn{
+		stream:  stream,
+		cancel:  cancel,
+		publish: publish,
+		reqres:  &sync.Map{},
+		done:    make(chan struct{}),
+	}
+
+	go c.listen()
+
+	return c, nil
+}
+
+// listen handles incoming messages from the Tinode server
+// It processes different types of messages (control, data, presence etc.)
+// and routes responses to the appropriate request handlers
+func (c *conn) listen() {
+	for {
+		msg, err := c.stream.Recv()
+		if err != nil {
+			if errors.Is(c.stream.Context().Err(), context.Canceled) {
+				slog.Debug("stream closed")
+			} else {
+				slog.Error("failed to receive message", "error", err)
+			}
+
+			// wake up every request in flight, see send
+			c.err = err
+			close(c.done)
+			return
+		}
+
+		switch m := msg.Message.(type) {
+		case *pbx.ServerMsg_Ctrl:
+			slog.Info("received control message", "code", m.Ctrl.Code, "msg", m.Ctrl.Text)
+
+			// Route control message to waiting request handler if one exists
+			if !c.route(m.Ctrl.Id, m) {
+				slog.Warn("received unawaited control message", "code", m.Ctrl.Code, "msg", m.Ctrl.Text, "id", m.Ctrl.Id)
+			}
+		case *pbx.ServerMsg_Data:
+			slog.Info("received data message", "topic", m.Data.Topic, "msg", "<bytes>", "length", len(m.Data.Content))
+			c.publish(dataEvent(m.Data))
+		case *pbx.ServerMsg_Pres:
+			slog.Info("received presence message", "topic", m.Pres.Topic, "msg", m.Pres.What.String())
+			c.publish(presEvent(m.Pres))
+		case *pbx.ServerMsg_Meta:
+			slog.Info("received metadata message", "topic", m.Meta.Topic, "msg", m.Meta.Desc)
+
+			// Route meta message to waiting request handler if one exists
+			if !c.route(m.Meta.Id, m) {
+				slog.Warn("received unawaited meta message", "topic", m.Meta.Topic, "msg", m.Meta.Desc)
+			}
+		case *pbx.ServerMsg_Info:
+			slog.Info("received info message", "topic", m.Info.Topic, "msg", m.Info.What.String())
+			c.publish(infoEvent(m.Info))
+		default:
+			slog.Error("received unknown message", "message", msg)
+		}
+	}
+}
+
+// route passes a response to the handler awaiting the request ID.
+// Returns false if no handler awaits the request.
+func (c *conn) route(rID string, msg any) bool {
+	ch, ok := c.reqres.Load(rID)
+	if !ok {
+		return false
+	}
+
+	// never block the event loop: the handler consumes only the first response
+	select {
+	case ch.(chan any) <- msg:
+	default:
+		slog.Warn("dropped extra response", "id", rID)
+	}
+	return true
+}
+
+// dataEvent converts a Tinode data message into a realtime event
+func dataEvent(d *pbx.ServerData) models.Event {
+	ts := time.UnixMilli(d.Timestamp)
+	ev := models.Event{
+		Type:      models.EventData,
+		Topic:     d.Topic,
+		From:      d.FromUserId,
+		SeqID:     d.SeqId,
+		Content:   d.Content,
+		Timestamp: &ts,
+	}
+	// head values are JSON encoded
+	if len(d.Head) > 0 {
+		ev.Head = make(map[string]json.RawMessage, len(d.Head))
+		for k, v := range d.Head {
+			ev.Head[k] = v
+		}
+	}
+	return ev
+}
+
+// presEvent converts a Tinode presence message into a realtime event
+func presEvent(p *pbx.ServerPres) models.Event {
+	ev := models.Event{
+		Type:  models.EventPres,
+		Topic: p.Topic,
+		Src:   p.Src,
+		What:  strings.ToLower(p.What.String()),
+		SeqID: p.SeqId,
+	}
+	for _, r := range p.DelSeq {
+		ev.DelSeq = append(ev.DelSeq, models.SeqRange{Low: r.Low, Hi: r.Hi})
+	}
+	return ev
+}
+
+// infoEvent converts a Tinode info message into a realtime event
+func infoEvent(i *pbx.ServerInfo) models.Event {
+	return models.Event{
+		Type:  models.EventInfo,
+		Topic: i.Topic,
+		From:  i.FromUserId,
+		What:  strings.ToLower(i.What.String()),
+		SeqID: i.SeqId,
+	}
+}
+
+// declareReq creates a new response channel for a request ID
+func (c *conn) declareReq(rID string) error {
+	// unfortunately, go type system doesn't allow us to create discriminated unions, so we have to use any (interface{})
+	if _, loaded := c.reqres.LoadOrStore(rID, make(chan any, 1)); loaded {
+		return errors.New("dublicate request id")
+	}
+	slog.Debug("declared request", "id", rID)
+
+	return nil
+}
+
+// revokeReq removes a response channel for a request ID
+func (c *conn) revokeReq(rID string) error {
+	if _, ok := c.reqres.LoadAndDelete(rID); !ok {
+		return errors.New("request not found")
+	}
+	slog.Debug("revoked request", "id", rID)
+	return nil
+}
+
+// send transmits a message to the Tinode server and waits for a response
+// ctx: Context of the request, requestTimeout is applied if it has no deadline
+// rID: Request ID for tracking the response
+// msg: Message to send
+// Returns the server response and any error, *ConnError if the stream breaks before the response arrives
+// and the context error if the request is cancelled or times out
+func (c *conn) send(ctx context.Context, rID string, msg *pbx.ClientMsg) (res any, err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+	}
+
+	err = c.declareReq(rID)
+	if err != nil {
+		slog.Error("failed to declare request", "error", err, "id", rID)
+		return res, err
+	}
+
+	defer func() {
+		err := c.revokeReq(rID)
+		if err != nil {
+			slog.Error("failed to revoke request", "error", err, "id", rID)
+		}
+	}()
+
+	slog.Debug("sending message", "id", rID, "msg", msg)
+	c.sendMu.Lock()
+	err = c.stream.Send(msg)
+	c.sendMu.Unlock()
+	if err != nil {
+		slog.Error("failed to send message", "error", err, "id", rID)
+		return res, &ConnError{Err: err}
+	}
+	slog.Debug("awaiting for response", "id", rID)
+	ch, ok := c.reqres.Load(rID)
+	if !ok {
+		return res, errors.New("internal error")
+	}
+
+	// Wait for response from event loop, the deferred revokeReq forgets the request on every path
+	select {
+	case res = <-ch.(chan any):
+	case <-c.done:
+		return res, &ConnError{Err: c.err}
+	case <-ctx.Done():
+		slog.Warn("request cancelled", "error", ctx.Err(), "id", rID)
+		return res, ctx.Err()
+	}
+	slog.Debug("received response", "res", res)
+
+	return res, nil
+}
+
+// notify transmits a message the server does not respond to, e.g. a note
+func (c *conn) notify(msg *pbx.ClientMsg) error {
+	slog.Debug("sending notification", "msg", msg)
+	c.sendMu.Lock()
+	err := c.stream.Send(msg)
+	c.sendMu.Unlock()
+	if err != nil {
+		slog.Error("failed to send notification", "error", err)
+		return &ConnError{Err: err}
+	}
+	return nil
+}
+
+// close terminates the stream
+func (c *conn) close() {
+	c.stream.CloseSend()
+	c.cancel()
+}
+
+// ping sends a Hi message to the server and waits for a response
+func ping(ctx context.Context, r requester) error {
+	rID := uuid.NewString()
+	rawres, err := r.send(ctx, rID, &pbx.ClientMsg{Message: &pbx.ClientMsg_Hi{
+		Hi: &pbx.ClientHi{
+			Id:        rID,
+			UserAgent: "golang/1.0",
+			Ver:       "0.22.13",
+			Lang:      "EN",
+		},
+	}})
+	if err != nil {
+		return err
+	}
+
+	_, err = ctrlResult(rID, rawres)
+	return err
+}
+
+// ctrlResult asserts that the response is a successful (2xx) ctrl message.
+// Returns *CtrlError carrying Tinode's code and text if the request was rejected.
+func ctrlResult(rID string, rawres any) (*pbx.ServerCtrl, error) {
+	res, ok := rawres.(*pbx.ServerMsg_Ctrl)
+	if !ok {
+		slog.Error("failed to project type to ServerMsg_Ctrl", "id", rID, "res", rawres)
+		return nil, errors.New("unexpected response from event loop")
+	}
+	slog.Debug("received response from event loop", "res", res)
+
+	if res.Ctrl.Code/100 != 2 {
+		slog.Error("unexpected response code", "code", res.Ctrl.Code, "text", res.Ctrl.Text, "id", rID)
+		return nil, &CtrlError{Code: res.Ctrl.Code, Text: res.Ctrl.Text}
+	}
+
+	return res.Ctrl, nil
+}
+
+// metaResult asserts that the response is a meta message.
+// Tinode replies with a ctrl message instead when the request is rejected, it is returned as *CtrlError.
+// A 204 ctrl message means there is nothing to report, it is returned as an empty meta message.
+func metaResult(rID string, rawres any) (*pbx.ServerMeta, error) {
+	switch res := rawres.(type) {
+	case *pbx.ServerMsg_Meta:
+		slog.Debug("received response from event loop", "res", res)
+		return res.Meta, nil
+	case *pbx.ServerMsg_Ctrl:
+		if res.Ctrl.Code == http.StatusNoContent {
+			return &pbx.ServerMeta{Id: res.Ctrl.Id, Topic: res.Ctrl.Topic}, nil
+		}
+		slog.Error("unexpected response code", "code", res.Ctrl.Code, "text", res.Ctrl.Text, "id", rID)
+		return nil, &CtrlError{Code: res.Ctrl.Code, Text: res.Ctrl.Text}
+	default:
+		slog.Error("failed to project type to ServerMsg_Meta", "id", rID, "res", rawres)
+		return nil, errors.New("unexpected response from event loop")
+	}
+}
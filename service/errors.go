@@ -0,0 +1,64 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSessionClosed is returned for requests sent through a session closed by the service (logout, eviction)
+var ErrSessionClosed = errors.New("tinode session closed")
+
+// ErrForbidden is returned when the user has no access to the requested topic or message
+var ErrForbidden = errors.New("access forbidden")
+
+// ErrNotFound is returned when the requested message does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrUnavailable is returned when the requested feature is not configured on this server
+var ErrUnavailable = errors.New("not available on this server")
+
+// ErrEmailNotVerified is returned when a user logs in before verifying the email
+var ErrEmailNotVerified = errors.New("email is not verified")
+
+// ErrWrongPassword is returned when the current password given to change it is wrong
+var ErrWrongPassword = errors.New("wrong password")
+
+// ErrInvalidToken is returned for refresh, verification and password reset tokens that are malformed, expired or revoked
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrTokenReuse is returned when a refresh token is used again after it was rotated,
+// the whole token family is revoked as the token has likely been stolen
+var ErrTokenReuse = errors.New("refresh token reused")
+
+// errReconnecting is wrapped by ConnError for requests sent while a session is reconnecting
+var errReconnecting = errors.New("reconnecting")
+
+// ConnError is returned when the stream to Tinode is unavailable: requests in flight
+// when the stream breaks and requests sent while the session is reconnecting fail with it
+type ConnError struct {
+	Err error
+}
+
+func (e *ConnError) Error() string {
+	return "tinode connection lost: " + e.Err.Error()
+}
+
+func (e *ConnError) Unwrap() error {
+	return e.Err
+}
+
+// CtrlError is returned when Tinode rejects a request, it carries the code and text of Tinode's ctrl response
+type CtrlError struct {
+	Code int32
+	Text string
+}
+
+func (e *CtrlError) Error() string {
+	return fmt.Sprintf("tinode rejected request: %d %s", e.Code, e.Text)
+}
+
+// isUnauthorized reports whether the error means the credentials are no longer accepted
+func isUnauthorized(err error) bool {
+	var ctrlErr *CtrlError
+	return errors.Is(err, ErrInvalidToken) || (errors.As(err, &ctrlErr) && ctrlErr.Code == 401)
+}
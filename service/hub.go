@@ -0,0 +1,127 @@
+package service
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/dartt0n/realtime-chat-backend/models"
+)
+
+// subscriptionBuffer is the number of events buffered per subscriber before
+// new events are dropped for that subscriber
+const subscriptionBuffer = 64
+
+// Hub fans out realtime events to subscribers grouped by key (e.g. access UUID of the user session)
+type Hub struct {
+	mu        sync.RWMutex
+	subs      map[string]map[*Subscription]struct{}
+	observers []func(key string, ev models.Event)
+}
+
+// Subscription receives events published to a single hub key
+type Subscription struct {
+	C <-chan models.Event
+
+	ch   chan models.Event
+	key  string
+	hub  *Hub
+	once sync.Once
+}
+
+// NewHub creates an empty Hub
+func NewHub() *Hub {
+	return &Hub{subs: make(map[string]map[*Subscription]struct{})}
+}
+
+// Subscribe registers a new subscriber for events published under the given key.
+// The returned subscription must be closed once the subscriber is done.
+func (h *Hub) Subscribe(key string) *Subscription {
+	ch := make(chan models.Event, subscriptionBuffer)
+	sub := &Subscription{C: ch, ch: ch, key: key, hub: h}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subs[key]; !ok {
+		h.subs[key] = make(map[*Subscription]struct{})
+	}
+	h.subs[key][sub] = struct{}{}
+	slog.Debug("subscribed to hub", "key", key)
+
+	return sub
+}
+
+// Observe registers a callback receiving every published event, whatever its key.
+// The callback runs on the event loop of the session publishing the event before the event
+// is delivered, so it must return quickly and hand slow work (e.g. I/O) off to a worker.
+func (h *Hub) Observe(fn func(key string, ev models.Event)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.observers = append(h.observers, fn)
+}
+
+// Publish delivers an event to every subscriber of the given key.
+// Publish never blocks: slow subscribers miss events instead of stalling the event loop.
+func (h *Hub) Publish(key string, ev models.Event) {
+	// observers run without the lock, so they never hold up subscribing and unsubscribing
+	h.mu.RLock()
+	observers := h.observers
+	h.mu.RUnlock()
+
+	for _, fn := range observers {
+		fn(key, ev)
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for sub := range h.subs[key] {
+		select {
+		case sub.ch <- ev:
+		default:
+			slog.Warn("dropped event for slow subscriber", "key", key, "type", ev.Type, "topic", ev.Topic)
+		}
+	}
+}
+
+// Terminate delivers a final event to every subscriber of the given key and closes their subscriptions,
+// so clients streaming the key disconnect.
+func (h *Hub) Terminate(key string, ev models.Event) {
+	h.Publish(key, ev)
+
+	h.mu.RLock()
+	subs := make([]*Subscription, 0, len(h.subs[key]))
+	for sub := range h.subs[key] {
+		subs = append(subs, sub)
+	}
+	h.mu.RUnlock()
+
+	// buffered events, including the final one, are still received after the channel is closed
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
+
+// HasSubscribers reports whether anyone is subscribed to the given key
+func (h *Hub) HasSubscribers(key string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.subs[key]) > 0
+}
+
+// Close unregisters the subscription and closes its channel
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.hub.mu.Lock()
+		defer s.hub.mu.Unlock()
+
+		delete(s.hub.subs[s.key], s)
+		if len(s.hub.subs[s.key]) == 0 {
+			delete(s.hub.subs, s.key)
+		}
+		close(s.ch)
+		slog.Debug("unsubscribed from hub", "key", s.key)
+	})
+}
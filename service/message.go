@@ -0,0 +1,461 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"github.com/google/uuid"
+	"github.com/tinode/chat/pbx"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+)
+
+// Message head keys understood by the service
+const (
+	headReplace  = "replace"  // ":<seq>" of the message the message replaces, i.e. an edit
+	headReaction = "reaction" // ":<seq>" of the message reacted to, the content is the emoji
+	headReply    = "reply"    // ":<seq>" of the root of the thread the message replies in
+	headPin      = "pin"      // ":<seq>" of the message pinned in the topic
+	headDeleted  = "deleted"  // true for replacements, reactions and pins retracting the original message, reaction or pin
+	headMIME     = "mime"     // format of the content, draftyMIME for Drafty documents
+)
+
+// draftyMIME is the head "mime" of messages with Drafty content
+const draftyMIME = "text/x-drafty"
+
+// seqRef formats a seq ID the way Tinode message heads reference other messages
+func seqRef(seq int32) string {
+	return ":" + strconv.FormatInt(int64(seq), 10)
+}
+
+// eventHeads are the head keys of messages which are events about other messages rather than messages of their own
+var eventHeads = []string{headReplace, headReaction, headPin}
+
+// notEvents returns the filter skipping messages which are events about other messages
+func notEvents() bson.D {
+	filter := make(bson.D, 0, len(eventHeads))
+	for _, key := range eventHeads {
+		filter = append(filter, bson.E{Key: "head." + key, Value: bson.D{bson.E{Key: "$exists", Value: false}}})
+	}
+	return filter
+}
+
+// notDeleted returns the filter skipping messages deleted for the user
+func notDeleted(userID models.UserID) bson.D {
+	return bson.D{
+		// hard-deleted messages keep their seq ID with a non-zero delete ID
+		bson.E{Key: "delid", Value: bson.D{bson.E{Key: "$not", Value: bson.D{bson.E{Key: "$gt", Value: 0}}}}},
+		// soft-deleted messages are hidden only from users who deleted them
+		bson.E{Key: "deletedfor.user", Value: bson.D{bson.E{Key: "$ne", Value: strings.TrimPrefix(string(userID), "usr")}}},
+	}
+}
+
+// originalMsgs returns the filter of the topic's messages which are not events about other messages
+func originalMsgs(topicID string) bson.D {
+	return append(bson.D{bson.E{Key: "topic", Value: topicID}}, notEvents()...)
+}
+
+// visibleMsgs returns the filter of the topic's original messages visible to the user:
+// replacements and reactions are merged into their originals, deleted messages are skipped
+func visibleMsgs(topicID string, userID models.UserID) bson.D {
+	return append(originalMsgs(topicID), notDeleted(userID)...)
+}
+
+// renderMsgs fills the plain text, HTML and attachments of the messages from their content
+func renderMsgs(messages []models.Message) {
+	for i := range messages {
+		messages[i].Text = messages[i].Content.PlainText()
+		messages[i].HTML = messages[i].Content.HTML()
+		messages[i].Attachments = messages[i].Content.Attachments()
+	}
+}
+
+// applyEdits replaces the content of edited messages with their latest edit and drops retracted messages.
+// Only edits by the author of the message or by a moderator of the topic are applied.
+func (s TinodeService) applyEdits(ctx context.Context, topicID string, messages []models.Message) ([]models.Message, error) {
+	if len(messages) == 0 {
+		return messages, nil
+	}
+
+	refs := make([]string, len(messages))
+	byRef := make(map[string]int, len(messages))
+	for i, m := range messages {
+		refs[i] = seqRef(m.SeqID)
+		byRef[refs[i]] = i
+	}
+
+	filter := bson.D{
+		bson.E{Key: "topic", Value: topicID},
+		bson.E{Key: "head." + headReplace, Value: bson.D{bson.E{Key: "$in", Value: refs}}},
+		bson.E{Key: "delid", Value: bson.D{bson.E{Key: "$not", Value: bson.D{bson.E{Key: "$gt", Value: 0}}}}},
+	}
+	cursor, err := s.history.Collection("messages").Find(ctx, filter, options.Find().SetSort(bson.D{bson.E{Key: "seqid", Value: 1}}))
+	if err != nil {
+		slog.Error("failed to fetch message edits", "error", err, "topic", topicID)
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var edits []models.Message
+	if err := cursor.All(ctx, &edits); err != nil {
+		slog.Error("failed to fetch all message edits", "error", err)
+		return nil, err
+	}
+	if len(edits) == 0 {
+		return messages, nil
+	}
+
+	// edits by someone else than the author must come from a moderator
+	var others []string
+	for _, e := range edits {
+		ref, _ := e.Head[headReplace].(string)
+		if i, ok := byRef[ref]; ok && e.Author != messages[i].Author {
+			others = append(others, e.Author)
+		}
+	}
+	mods, err := s.moderators(ctx, topicID, others)
+	if err != nil {
+		return nil, err
+	}
+
+	retracted := make(map[int]bool)
+	for _, e := range edits {
+		ref, _ := e.Head[headReplace].(string)
+		i, ok := byRef[ref]
+		if !ok || (e.Author != messages[i].Author && !mods[e.Author]) {
+			continue
+		}
+
+		// edits are sorted oldest first, so the latest one wins
+		if deleted, _ := e.Head[headDeleted].(bool); deleted {
+			retracted[i] = true
+			continue
+		}
+		editedAt := e.Timestamp
+		messages[i].Content = e.Content
+		messages[i].EditedAt = &editedAt
+	}
+
+	visible := messages[:0]
+	for i, m := range messages {
+		if !retracted[i] {
+			visible = append(visible, m)
+		}
+	}
+	return visible, nil
+}
+
+// findMessage returns the original message of the topic with the given seq ID
+func (s TinodeService) findMessage(ctx context.Context, topicID string, seq int32) (msg models.Message, err error) {
+	// the message may have been sent a moment ago, so it is read from the primary
+	messages := s.history.Collection("messages", options.Collection().SetReadPreference(readpref.Primary()))
+	filter := append(originalMsgs(topicID),
+		bson.E{Key: "seqid", Value: seq},
+		bson.E{Key: "delid", Value: bson.D{bson.E{Key: "$not", Value: bson.D{bson.E{Key: "$gt", Value: 0}}}}},
+	)
+
+	err = messages.FindOne(ctx, filter).Decode(&msg)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return msg, ErrNotFound
+	}
+	if err != nil {
+		slog.Error("failed to fetch message", "error", err, "topic", topicID, "seq_id", seq)
+	}
+	return msg, err
+}
+
+// authorizeChange checks that the user may edit or delete the message: only its author and moderators may.
+// Returns the access mode of the user's subscription to the topic.
+func (s TinodeService) authorizeChange(ctx context.Context, userID models.UserID, topicID string, seq int32) (int64, error) {
+	mode, err := s.subscriptionMode(ctx, userID, topicID)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := s.findMessage(ctx, topicID, seq)
+	if err != nil {
+		return 0, err
+	}
+
+	if msg.Author != strings.TrimPrefix(string(userID), "usr") && !isModerator(mode) {
+		return 0, ErrForbidden
+	}
+	return mode, nil
+}
+
+// EditMessage replaces the content of the message with a new one, keeping its seq ID.
+// Only the author of the message and moderators of the topic may edit it.
+func (s TinodeService) EditMessage(ctx context.Context, accessUUID string, userID models.UserID, topicID string, seq int32, content models.Content) error {
+	if _, err := s.authorizeChange(ctx, userID, topicID, seq); err != nil {
+		return err
+	}
+
+	ref, err := json.Marshal(seqRef(seq))
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	return s.publish(ctx, accessUUID, topicID, contentHead(map[string][]byte{headReplace: ref}, content), raw)
+}
+
+// DeleteMessage deletes the message for all users of the topic.
+// Only the author of the message and moderators of the topic may delete it.
+func (s TinodeService) DeleteMessage(ctx context.Context, accessUUID string, userID models.UserID, topicID string, seq int32) error {
+	mode, err := s.authorizeChange(ctx, userID, topicID, seq)
+	if err != nil {
+		return err
+	}
+
+	// Tinode hard-deletes messages only for users with the D permission,
+	// authors without it retract their message by replacing it with a tombstone
+	if mode&modeDelete == 0 {
+		ref, err := json.Marshal(seqRef(seq))
+		if err != nil {
+			return err
+		}
+		return s.publish(ctx, accessUUID, topicID, map[string][]byte{headReplace: ref, headDeleted: []byte("true")}, []byte(`""`))
+	}
+
+	rID := uuid.NewString()
+
+	sess, err := s.sessions.Get(ctx, accessUUID)
+	if err != nil {
+		return err
+	}
+
+	msg := &pbx.ClientMsg{Message: &pbx.ClientMsg_Del{
+		Del: &pbx.ClientDel{
+			Id:     rID,
+			Topic:  topicID,
+			What:   pbx.ClientDel_MSG,
+			DelSeq: []*pbx.SeqRange{{Low: seq}},
+			Hard:   true,
+		},
+	}}
+
+	rawres, err := sess.send(ctx, rID, msg)
+	if err != nil {
+		slog.Error("failed to send delete message", "error", err, "id", rID)
+		return err
+	}
+
+	_, err = ctrlResult(rID, rawres)
+	return err
+}
+
+// applyReactions aggregates the reactions to the messages: emoji to the users who reacted with it
+func (s TinodeService) applyReactions(ctx context.Context, topicID string, messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	refs := make([]string, len(messages))
+	byRef := make(map[string]int, len(messages))
+	for i, m := range messages {
+		refs[i] = seqRef(m.SeqID)
+		byRef[refs[i]] = i
+	}
+
+	filter := bson.D{
+		bson.E{Key: "topic", Value: topicID},
+		bson.E{Key: "head." + headReaction, Value: bson.D{bson.E{Key: "$in", Value: refs}}},
+		bson.E{Key: "delid", Value: bson.D{bson.E{Key: "$not", Value: bson.D{bson.E{Key: "$gt", Value: 0}}}}},
+	}
+	cursor, err := s.history.Collection("messages").Find(ctx, filter, options.Find().SetSort(bson.D{bson.E{Key: "seqid", Value: 1}}))
+	if err != nil {
+		slog.Error("failed to fetch message reactions", "error", err, "topic", topicID)
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var reactions []models.Message
+	if err := cursor.All(ctx, &reactions); err != nil {
+		slog.Error("failed to fetch all message reactions", "error", err)
+		return err
+	}
+
+	// reactions are sorted oldest first, so the latest reaction of a user with an emoji wins
+	reacted := make(map[int]map[string]map[string]bool)
+	for _, r := range reactions {
+		ref, _ := r.Head[headReaction].(string)
+		i, ok := byRef[ref]
+		emoji := r.Content.PlainText()
+		if !ok || emoji == "" {
+			continue
+		}
+
+		if reacted[i] == nil {
+			reacted[i] = make(map[string]map[string]bool)
+		}
+		if reacted[i][emoji] == nil {
+			reacted[i][emoji] = make(map[string]bool)
+		}
+		deleted, _ := r.Head[headDeleted].(bool)
+		reacted[i][emoji]["usr"+r.Author] = !deleted
+	}
+
+	for i, emojis := range reacted {
+		for emoji, users := range emojis {
+			for user, ok := range users {
+				if !ok {
+					continue
+				}
+				if messages[i].Reactions == nil {
+					messages[i].Reactions = make(map[string][]string)
+				}
+				messages[i].Reactions[emoji] = append(messages[i].Reactions[emoji], user)
+			}
+			slices.Sort(messages[i].Reactions[emoji])
+		}
+	}
+	return nil
+}
+
+// React adds a reaction of the user to the message, or removes it.
+// Reactions are published as messages to the topic, so subscribers receive them live.
+func (s TinodeService) React(ctx context.Context, accessUUID string, userID models.UserID, topicID string, seq int32, emoji string, remove bool) error {
+	if err := s.checkAccess(ctx, userID, topicID, modeRead|modeWrite); err != nil {
+		return err
+	}
+	if _, err := s.findMessage(ctx, topicID, seq); err != nil {
+		return err
+	}
+
+	ref, err := json.Marshal(seqRef(seq))
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(emoji)
+	if err != nil {
+		return err
+	}
+
+	head := map[string][]byte{headReaction: ref}
+	if remove {
+		head[headDeleted] = []byte("true")
+	}
+	return s.publish(ctx, accessUUID, topicID, head, content)
+}
+
+// parseSeqRef parses a seq ID referenced by a message head, returns zero for invalid references
+func parseSeqRef(ref any) int32 {
+	str, _ := ref.(string)
+	seq, err := strconv.ParseInt(strings.TrimPrefix(str, ":"), 10, 32)
+	if err != nil || !strings.HasPrefix(str, ":") {
+		return 0
+	}
+	return int32(seq)
+}
+
+// threadRoot returns the seq ID of the root of the thread a reply to the message belongs to.
+// Threads are flat: replies to replies join the thread of the root.
+func (s TinodeService) threadRoot(ctx context.Context, topicID string, seq int32) (int32, error) {
+	msg, err := s.findMessage(ctx, topicID, seq)
+	if err != nil {
+		return 0, err
+	}
+	if root := parseSeqRef(msg.Head[headReply]); root > 0 {
+		return root, nil
+	}
+	return seq, nil
+}
+
+// applyThreads fills the number of replies and the time of the latest reply of the messages.
+// Replies retracted by their authors are counted until Tinode deletes them.
+func (s TinodeService) applyThreads(ctx context.Context, userID models.UserID, topicID string, messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	refs := make([]string, len(messages))
+	byRef := make(map[string]int, len(messages))
+	for i, m := range messages {
+		refs[i] = seqRef(m.SeqID)
+		byRef[refs[i]] = i
+	}
+
+	pipeline := bson.A{
+		bson.D{bson.E{Key: "$match", Value: append(visibleMsgs(topicID, userID),
+			bson.E{Key: "head." + headReply, Value: bson.D{bson.E{Key: "$in", Value: refs}}})}},
+		bson.D{bson.E{Key: "$group", Value: bson.D{
+			bson.E{Key: "_id", Value: "$head." + headReply},
+			bson.E{Key: "count", Value: bson.D{bson.E{Key: "$sum", Value: 1}}},
+			bson.E{Key: "last", Value: bson.D{bson.E{Key: "$max", Value: "$createdat"}}},
+		}}},
+	}
+	cursor, err := s.history.Collection("messages").Aggregate(ctx, pipeline)
+	if err != nil {
+		slog.Error("failed to count message replies", "error", err, "topic", topicID)
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	var threads []struct {
+		Ref   string    `bson:"_id"`
+		Count int32     `bson:"count"`
+		Last  time.Time `bson:"last"`
+	}
+	if err := cursor.All(ctx, &threads); err != nil {
+		slog.Error("failed to count all message replies", "error", err)
+		return err
+	}
+
+	for _, t := range threads {
+		if i, ok := byRef[t.Ref]; ok {
+			last := t.Last
+			messages[i].Replies = t.Count
+			messages[i].LastReplyAt = &last
+		}
+	}
+	return nil
+}
+
+// FetchThread returns the root message of the thread and a page of its replies, see FetchMsgs for paging
+func (s TinodeService) FetchThread(ctx context.Context, userID models.UserID, topicID string, seq int32, query forms.HistoryQuery) (thread models.Thread, err error) {
+	if err := s.checkAccess(ctx, userID, topicID, modeRead); err != nil {
+		return thread, err
+	}
+
+	root, err := s.findMessage(ctx, topicID, seq)
+	if err != nil {
+		return thread, err
+	}
+	// replies are not roots of threads of their own
+	if parseSeqRef(root.Head[headReply]) > 0 {
+		return thread, ErrNotFound
+	}
+	roots, err := s.applyEdits(ctx, topicID, []models.Message{root})
+	if err != nil {
+		return thread, err
+	}
+	if len(roots) == 0 {
+		return thread, ErrNotFound
+	}
+	if err := s.applyReactions(ctx, topicID, roots); err != nil {
+		return thread, err
+	}
+	if err := s.applyThreads(ctx, userID, topicID, roots); err != nil {
+		return thread, err
+	}
+	renderMsgs(roots)
+	thread.Root = roots[0]
+
+	filter := append(visibleMsgs(topicID, userID), bson.E{Key: "head." + headReply, Value: seqRef(seq)})
+	thread.MessagePage, err = s.fetchPage(ctx, topicID, filter, query)
+	return thread, err
+}
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dartt0n/realtime-chat-backend/kv"
+	"github.com/dartt0n/realtime-chat-backend/mail"
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"github.com/google/uuid"
+	"github.com/tinode/chat/pbx"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const (
+	// resetTokenTTL is how long a password reset token can be used
+	resetTokenTTL = time.Hour
+	// resetInterval is the minimal interval between password reset emails sent to a user
+	resetInterval = time.Minute
+)
+
+// PasswordService recovers accounts with single-use tokens mailed to their email and changes passwords.
+// Every session of the user is revoked once the password is changed.
+type PasswordService struct {
+	kv     kv.KeyValueStore
+	mailer mail.Mailer
+	tinode *TinodeService
+	auth   *AuthService
+	link   string // URL of the password reset page, the token is appended as a query parameter
+}
+
+// NewPasswordService creates a PasswordService sending reset tokens through the mailer.
+// link: URL of the frontend page submitting the token, empty to send the bare token
+func NewPasswordService(kv kv.KeyValueStore, mailer mail.Mailer, tinode *TinodeService, auth *AuthService, link string) *PasswordService {
+	return &PasswordService{kv: kv, mailer: mailer, tinode: tinode, auth: auth, link: link}
+}
+
+// resetTokenKey returns the key of the user a password reset token was sent to
+func resetTokenKey(token string) string {
+	return "password:reset:" + token
+}
+
+// Forgot mails a password reset token if the email is registered.
+// Unknown emails and requests sent too often are ignored, so the response
+// does not reveal whether the email is registered.
+// Returns ErrUnavailable if no Tinode root user is configured, as passwords are reset through it.
+func (s PasswordService) Forgot(ctx context.Context, email string) error {
+	if s.tinode.root == nil {
+		return ErrUnavailable
+	}
+
+	userID, err := s.tinode.userByEmail(ctx, email)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	allowed, err := s.kv.SetNX("password:forgot:"+userID.String(), "1", resetInterval)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return nil
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if err := s.kv.Set(resetTokenKey(token), userID.String(), resetTokenTTL); err != nil {
+		return err
+	}
+
+	body := "A password reset was requested for your account. Use the following code to choose a new password:\n\n" + token + "\n"
+	if s.link != "" {
+		body += "\nor open this link:\n\n" + s.link + "?token=" + url.QueryEscape(token) + "\n"
+	}
+	body += "\nThe code expires in 1 hour. If you did not request it, please ignore this email.\n"
+
+	return s.mailer.Send(ctx, mail.Message{To: email, Subject: "Reset your password", Body: body})
+}
+
+// Reset sets the password of the user the token was sent to, tokens can be used once
+func (s PasswordService) Reset(ctx context.Context, token, password string) error {
+	if s.tinode.root == nil {
+		return ErrUnavailable
+	}
+
+	raw, err := s.kv.Get(resetTokenKey(token))
+	if err != nil {
+		return ErrInvalidToken
+	}
+	// deletion succeeds only once, so a token can not be used twice
+	if _, err := s.kv.Del(resetTokenKey(token)); err != nil {
+		return ErrInvalidToken
+	}
+	userID, err := models.ParseUserID(raw)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if err := s.tinode.setPassword(ctx, userID, password); err != nil {
+		return err
+	}
+	slog.Info("password reset", "user_id", userID)
+	return s.auth.RevokeSessions(userID)
+}
+
+// Change replaces the password of the logged-in user, the current password must be given
+func (s PasswordService) Change(ctx context.Context, accessUUID string, userID models.UserID, oldPassword, newPassword string) error {
+	if err := s.tinode.changePassword(ctx, accessUUID, userID, oldPassword, newPassword); err != nil {
+		return err
+	}
+	slog.Info("password changed", "user_id", userID)
+	return s.auth.RevokeSessions(userID)
+}
+
+// authRecord is a credential stored by Tinode, _id is "<scheme>:<username>"
+type authRecord struct {
+	ID     string `bson:"_id"`
+	UserID string `bson:"userid"`
+}
+
+// userByEmail returns the user registered with the email, the username is derived from the email
+func (s TinodeService) userByEmail(ctx context.Context, email string) (models.UserID, error) {
+	var rec authRecord
+	err := s.history.Collection("auth").FindOne(ctx, bson.D{
+		bson.E{Key: "_id", Value: "basic:" + generateUsername(email)},
+	}).Decode(&rec)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		slog.Error("failed to fetch user credentials", "error", err)
+		return "", err
+	}
+	return models.ParseUserID("usr" + rec.UserID)
+}
+
+// basicUsername returns the username of the user's basic credentials
+func (s TinodeService) basicUsername(ctx context.Context, userID models.UserID) (string, error) {
+	var rec authRecord
+	err := s.history.Collection("auth").FindOne(ctx, bson.D{
+		bson.E{Key: "userid", Value: strings.TrimPrefix(string(userID), "usr")},
+		bson.E{Key: "scheme", Value: "basic"},
+	}).Decode(&rec)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		slog.Error("failed to fetch user credentials", "error", err, "user", userID)
+		return "", err
+	}
+	return strings.TrimPrefix(rec.ID, "basic:"), nil
+}
+
+// passwordMsg returns the message replacing the basic secret of the user, the username is kept
+func passwordMsg(rID string, userID models.UserID, username, password string) *pbx.ClientMsg {
+	return &pbx.ClientMsg{Message: &pbx.ClientMsg_Acc{
+		Acc: &pbx.ClientAcc{
+			Id:     rID,
+			UserId: string(userID),
+			Scheme: "basic",
+			Secret: []byte(username + ":" + password),
+		},
+	}}
+}
+
+// setPassword replaces the password of the user through the root session, the current password is not needed
+func (s TinodeService) setPassword(ctx context.Context, userID models.UserID, password string) error {
+	if s.root == nil {
+		return ErrUnavailable
+	}
+
+	username, err := s.basicUsername(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	rID := uuid.NewString()
+	rawres, err := s.rootSend(ctx, userID, rID, passwordMsg(rID, userID, username, password))
+	if err != nil {
+		slog.Error("failed to send password update message", "error", err, "id", rID)
+		return err
+	}
+	_, err = ctrlResult(rID, rawres)
+	return err
+}
+
+// changePassword replaces the password of the user through the user's own session after checking the current one
+func (s TinodeService) changePassword(ctx context.Context, accessUUID string, userID models.UserID, oldPassword, newPassword string) error {
+	username, err := s.basicUsername(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	// the user's session is authenticated already, so the password is checked on a short-lived one
+	checkSess, err := newSession(ctx, s.client, s.hub, "", nil)
+	if err != nil {
+		slog.Error("failed to open login session", "error", err)
+		return err
+	}
+	defer checkSess.close()
+
+	if _, _, err := login(ctx, checkSess, "basic", []byte(username+":"+oldPassword)); err != nil {
+		var ctrlErr *CtrlError
+		if errors.As(err, &ctrlErr) && ctrlErr.Code == 401 {
+			return ErrWrongPassword
+		}
+		return err
+	}
+
+	sess, err := s.sessions.Get(ctx, accessUUID)
+	if err != nil {
+		return err
+	}
+
+	rID := uuid.NewString()
+	rawres, err := sess.send(ctx, rID, passwordMsg(rID, userID, username, newPassword))
+	if err != nil {
+		slog.Error("failed to send password update message", "error", err, "id", rID)
+		return err
+	}
+	_, err = ctrlResult(rID, rawres)
+	return err
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"github.com/google/uuid"
+	"github.com/tinode/chat/pbx"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+)
+
+// maxPins is the number of messages pinned in a topic at once, the oldest pin is dropped beyond it
+const maxPins = 10
+
+// auxPins is the key of the topic's aux data holding the seq IDs of pinned messages, the latest pin first
+const auxPins = "pins"
+
+// topicPins returns the seq IDs of the messages pinned in the topic, the latest pin first
+func (s TinodeService) topicPins(ctx context.Context, topicID string) ([]int32, error) {
+	var rec topicRecord
+
+	// pins are changed with read-modify-write, so they are read from the primary
+	topics := s.history.Collection("topics", options.Collection().SetReadPreference(readpref.Primary()))
+	err := topics.FindOne(ctx, bson.D{bson.E{Key: "_id", Value: topicID}}).Decode(&rec)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		slog.Error("failed to fetch topic pins", "error", err, "topic", topicID)
+		return nil, err
+	}
+	return rec.Aux.Pins, nil
+}
+
+// setPins replaces the pins stored in the topic's aux data
+func (s TinodeService) setPins(ctx context.Context, accessUUID, topicID string, pins []int32) error {
+	rID := uuid.NewString()
+
+	sess, err := s.sessions.Get(ctx, accessUUID)
+	if err != nil {
+		return err
+	}
+	// topic metadata can be changed only by sessions attached to the topic
+	if err := attachTopic(ctx, sess, topicID); err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(append([]int32{}, pins...))
+	if err != nil {
+		return err
+	}
+
+	msg := &pbx.ClientMsg{Message: &pbx.ClientMsg_Set{
+		Set: &pbx.ClientSet{
+			Id:    rID,
+			Topic: topicID,
+			Query: &pbx.SetQuery{Aux: map[string][]byte{auxPins: raw}},
+		},
+	}}
+
+	rawres, err := sess.send(ctx, rID, msg)
+	if err != nil {
+		slog.Error("failed to send set aux message", "error", err, "id", rID)
+		return err
+	}
+
+	_, err = ctrlResult(rID, rawres)
+	return err
+}
+
+// PinMessage pins the message in the topic, only moderators of the topic may pin messages.
+// Subscribers are notified with a message with the pin head, it is not a part of the history.
+func (s TinodeService) PinMessage(ctx context.Context, accessUUID string, userID models.UserID, topicID string, seq int32) error {
+	return s.changePin(ctx, accessUUID, userID, topicID, seq, false)
+}
+
+// UnpinMessage unpins the message in the topic, only moderators of the topic may unpin messages
+func (s TinodeService) UnpinMessage(ctx context.Context, accessUUID string, userID models.UserID, topicID string, seq int32) error {
+	return s.changePin(ctx, accessUUID, userID, topicID, seq, true)
+}
+
+// changePin pins or unpins the message and notifies subscribers of the topic
+func (s TinodeService) changePin(ctx context.Context, accessUUID string, userID models.UserID, topicID string, seq int32, unpin bool) error {
+	mode, err := s.subscriptionMode(ctx, userID, topicID)
+	if err != nil {
+		return err
+	}
+	if !isModerator(mode) {
+		return ErrForbidden
+	}
+
+	pins, err := s.topicPins(ctx, topicID)
+	if err != nil {
+		return err
+	}
+
+	pinned := slices.Contains(pins, seq)
+	switch {
+	case unpin && !pinned:
+		return ErrNotFound
+	case unpin:
+		pins = slices.DeleteFunc(pins, func(p int32) bool { return p == seq })
+	case pinned:
+		return nil
+	default:
+		if _, err := s.findMessage(ctx, topicID, seq); err != nil {
+			return err
+		}
+		pins = append([]int32{seq}, pins...)
+		if len(pins) > maxPins {
+			pins = pins[:maxPins]
+		}
+	}
+
+	if err := s.setPins(ctx, accessUUID, topicID, pins); err != nil {
+		return err
+	}
+
+	ref, err := json.Marshal(seqRef(seq))
+	if err != nil {
+		return err
+	}
+	head := map[string][]byte{headPin: ref}
+	if unpin {
+		head[headDeleted] = []byte("true")
+	}
+	return s.publish(ctx, accessUUID, topicID, head, []byte(`""`))
+}
+
+// PinnedMessages returns the messages pinned in the topic, the latest pin first
+func (s TinodeService) PinnedMessages(ctx context.Context, userID models.UserID, topicID string) ([]models.Message, error) {
+	if err := s.checkAccess(ctx, userID, topicID, modeRead); err != nil {
+		return nil, err
+	}
+
+	pins, err := s.topicPins(ctx, topicID)
+	if err != nil {
+		return nil, err
+	}
+	if len(pins) == 0 {
+		return []models.Message{}, nil
+	}
+
+	filter := append(visibleMsgs(topicID, userID), bson.E{Key: "seqid", Value: bson.D{bson.E{Key: "$in", Value: pins}}})
+	cursor, err := s.history.Collection("messages").Find(ctx, filter)
+	if err != nil {
+		slog.Error("failed to fetch pinned messages", "error", err, "topic", topicID)
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var messages []models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		slog.Error("failed to fetch all pinned messages", "error", err)
+		return nil, err
+	}
+
+	order := make(map[int32]int, len(pins))
+	for i, seq := range pins {
+		order[seq] = i
+	}
+	slices.SortFunc(messages, func(a, b models.Message) int {
+		return order[a.SeqID] - order[b.SeqID]
+	})
+
+	messages, err = s.applyEdits(ctx, topicID, messages)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.applyReactions(ctx, topicID, messages); err != nil {
+		return nil, err
+	}
+	if err := s.applyThreads(ctx, userID, topicID, messages); err != nil {
+		return nil, err
+	}
+	renderMsgs(messages)
+	return messages, nil
+}
@@ -0,0 +1,305 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dartt0n/realtime-chat-backend/kv"
+	"github.com/dartt0n/realtime-chat-backend/models"
+)
+
+// presenceSyncTTL is how long the online users of a topic are trusted before they are
+// synchronized with Tinode again. Presence updates are received only while some session
+// is attached to the topic, so the list may go stale when none is.
+const presenceSyncTTL = 5 * time.Minute
+
+// presenceFlushDelay is how long presence updates are collected before they are applied to the store.
+// Every session attached to a topic receives the same event, the delay lets the copies coalesce.
+const presenceFlushDelay = 50 * time.Millisecond
+
+// PresenceStore keeps track of the users online in each topic
+type PresenceStore interface {
+	// Add marks the user online in the topic
+	Add(topic string, user models.UserID) error
+	// Remove marks the user offline in the topic
+	Remove(topic string, user models.UserID) error
+	// Reset replaces the online users of the topic, the list is considered synchronized for ttl
+	Reset(topic string, users []models.UserID, ttl time.Duration) error
+	// Online returns the online users of the topic and whether the list is still synchronized
+	Online(topic string) (users []models.UserID, synced bool, err error)
+}
+
+// MemoryPresence implements PresenceStore in memory, it suits a single backend replica
+type MemoryPresence struct {
+	mu     sync.RWMutex
+	topics map[string]*topicPresence
+}
+
+type topicPresence struct {
+	users       map[models.UserID]struct{}
+	syncedUntil time.Time
+}
+
+var _ PresenceStore = (*MemoryPresence)(nil)
+
+// NewMemoryPresence creates an empty MemoryPresence
+func NewMemoryPresence() *MemoryPresence {
+	return &MemoryPresence{topics: make(map[string]*topicPresence)}
+}
+
+// topic returns the presence of the topic, creating it if needed. Must be called with p.mu held.
+func (p *MemoryPresence) topic(topic string) *topicPresence {
+	tp, ok := p.topics[topic]
+	if !ok {
+		tp = &topicPresence{users: make(map[models.UserID]struct{})}
+		p.topics[topic] = tp
+	}
+	return tp
+}
+
+// Add marks the user online in the topic
+func (p *MemoryPresence) Add(topic string, user models.UserID) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.topic(topic).users[user] = struct{}{}
+	return nil
+}
+
+// Remove marks the user offline in the topic
+func (p *MemoryPresence) Remove(topic string, user models.UserID) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.topic(topic).users, user)
+	return nil
+}
+
+// Reset replaces the online users of the topic
+func (p *MemoryPresence) Reset(topic string, users []models.UserID, ttl time.Duration) error {
+	tp := &topicPresence{users: make(map[models.UserID]struct{}, len(users)), syncedUntil: time.Now().Add(ttl)}
+	for _, u := range users {
+		tp.users[u] = struct{}{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.topics[topic] = tp
+	return nil
+}
+
+// Online returns the online users of the topic
+func (p *MemoryPresence) Online(topic string) (users []models.UserID, synced bool, err error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	tp, ok := p.topics[topic]
+	if !ok {
+		return nil, false, nil
+	}
+
+	users = make([]models.UserID, 0, len(tp.users))
+	for u := range tp.users {
+		users = append(users, u)
+	}
+	return users, time.Now().Before(tp.syncedUntil), nil
+}
+
+// KVPresence implements PresenceStore on top of a key-value store, so all backend replicas share it
+type KVPresence struct {
+	kv kv.KeyValueStore
+}
+
+var _ PresenceStore = (*KVPresence)(nil)
+
+// NewKVPresence creates a KVPresence storing online users as sets in the key-value store
+func NewKVPresence(kv kv.KeyValueStore) *KVPresence {
+	return &KVPresence{kv: kv}
+}
+
+// presenceKey returns the key of the set of users online in the topic
+func presenceKey(topic string) string {
+	return "presence:" + topic
+}
+
+// presenceSyncedKey returns the key whose existence marks the online users of the topic as synchronized
+func presenceSyncedKey(topic string) string {
+	return "presence:" + topic + ":synced"
+}
+
+// Add marks the user online in the topic
+func (p *KVPresence) Add(topic string, user models.UserID) error {
+	return p.kv.SAdd(presenceKey(topic), string(user))
+}
+
+// Remove marks the user offline in the topic
+func (p *KVPresence) Remove(topic string, user models.UserID) error {
+	return p.kv.SRem(presenceKey(topic), string(user))
+}
+
+// Reset replaces the online users of the topic
+func (p *KVPresence) Reset(topic string, users []models.UserID, ttl time.Duration) error {
+	// Del fails for missing keys, the set is empty either way
+	p.kv.Del(presenceKey(topic))
+
+	if len(users) > 0 {
+		members := make([]string, len(users))
+		for i, u := range users {
+			members[i] = string(u)
+		}
+		if err := p.kv.SAdd(presenceKey(topic), members...); err != nil {
+			return err
+		}
+	}
+
+	return p.kv.Set(presenceSyncedKey(topic), "1", ttl)
+}
+
+// Online returns the online users of the topic
+func (p *KVPresence) Online(topic string) (users []models.UserID, synced bool, err error) {
+	members, err := p.kv.SMembers(presenceKey(topic))
+	if err != nil {
+		return nil, false, err
+	}
+
+	users = make([]models.UserID, len(members))
+	for i, m := range members {
+		users[i] = models.UserID(m)
+	}
+
+	// a missing marker and a failed lookup both lead to a new synchronization
+	_, err = p.kv.Get(presenceSyncedKey(topic))
+	return users, err == nil, nil
+}
+
+// presenceChange identifies the user whose presence changed in a topic
+type presenceChange struct {
+	topic string
+	user  models.UserID
+}
+
+// presenceTracker applies presence changes to the store on a worker of its own,
+// so stores doing I/O do not stall the event loops the changes are seen on
+type presenceTracker struct {
+	store PresenceStore
+
+	mu      sync.Mutex
+	pending map[presenceChange]bool // latest state of each changed user, true if online
+	wake    chan struct{}
+}
+
+// newPresenceTracker creates a presenceTracker and starts its worker
+func newPresenceTracker(store PresenceStore) *presenceTracker {
+	t := &presenceTracker{
+		store:   store,
+		pending: make(map[presenceChange]bool),
+		wake:    make(chan struct{}, 1),
+	}
+	go t.run()
+	return t
+}
+
+// track records the presence of the user in the topic, it never blocks on the store
+func (t *presenceTracker) track(topic string, user models.UserID, online bool) {
+	t.mu.Lock()
+	t.pending[presenceChange{topic: topic, user: user}] = online
+	t.mu.Unlock()
+
+	select {
+	case t.wake <- struct{}{}:
+	default: // the worker is woken up already
+	}
+}
+
+// run applies the pending changes, only the latest state of each user is written
+func (t *presenceTracker) run() {
+	for range t.wake {
+		time.Sleep(presenceFlushDelay)
+
+		t.mu.Lock()
+		changes := t.pending
+		t.pending = make(map[presenceChange]bool)
+		t.mu.Unlock()
+
+		for c, online := range changes {
+			var err error
+			if online {
+				err = t.store.Add(c.topic, c.user)
+			} else {
+				err = t.store.Remove(c.topic, c.user)
+			}
+			if err != nil {
+				slog.Error("failed to update presence", "error", err, "topic", c.topic, "user", c.user)
+			}
+		}
+	}
+}
+
+// trackPresence records on/off presence events of group topics.
+// Every session attached to a topic receives the same events, the copies are coalesced by the tracker.
+func (s TinodeService) trackPresence(_ string, ev models.Event) {
+	if ev.Type != models.EventPres || !strings.HasPrefix(ev.Topic, "grp") {
+		return
+	}
+	user, err := models.ParseUserID(ev.Src)
+	if err != nil {
+		return
+	}
+
+	switch ev.What {
+	case "on":
+		s.tracker.track(ev.Topic, user, true)
+	case "off":
+		s.tracker.track(ev.Topic, user, false)
+	}
+}
+
+// OnlineUsers returns the users currently online in the topic.
+// The list is synchronized with Tinode's subscriptions when it is missing or stale.
+func (s TinodeService) OnlineUsers(ctx context.Context, accessUUID string, userID models.UserID, topicID string) ([]models.UserID, error) {
+	// presence is served from the store, so Tinode's presence permission is checked here
+	if err := s.checkAccess(ctx, userID, topicID, modePres); err != nil {
+		return nil, err
+	}
+
+	users, synced, err := s.presence.Online(topicID)
+	if err != nil {
+		return nil, err
+	}
+	if synced {
+		slices.Sort(users)
+		return users, nil
+	}
+
+	sess, err := s.sessions.Get(ctx, accessUUID)
+	if err != nil {
+		return nil, err
+	}
+	// subscriptions can be listed only by sessions attached to the topic
+	if err := attachTopic(ctx, sess, topicID); err != nil {
+		return nil, err
+	}
+	subs, err := topicSubs(ctx, sess, topicID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the requesting user is online, even if the user's only client is not attached to the topic
+	users = []models.UserID{userID}
+	for _, sub := range subs {
+		if sub.Online && sub.UserId != string(userID) {
+			users = append(users, models.UserID(sub.UserId))
+		}
+	}
+	slices.Sort(users)
+
+	if err := s.presence.Reset(topicID, users, presenceSyncTTL); err != nil {
+		slog.Error("failed to reset presence", "error", err, "topic", topicID)
+	}
+	return users, nil
+}
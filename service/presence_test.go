@@ -0,0 +1,60 @@
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dartt0n/realtime-chat-backend/models"
+)
+
+// countingPresence is a MemoryPresence counting the writes it receives
+type countingPresence struct {
+	*MemoryPresence
+	mu     sync.Mutex
+	writes int
+}
+
+func (p *countingPresence) Add(topic string, user models.UserID) error {
+	p.mu.Lock()
+	p.writes++
+	p.mu.Unlock()
+	return p.MemoryPresence.Add(topic, user)
+}
+
+func (p *countingPresence) Remove(topic string, user models.UserID) error {
+	p.mu.Lock()
+	p.writes++
+	p.mu.Unlock()
+	return p.MemoryPresence.Remove(topic, user)
+}
+
+func TestPresenceTrackerCoalesces(t *testing.T) {
+	store := &countingPresence{MemoryPresence: NewMemoryPresence()}
+	tracker := newPresenceTracker(store)
+
+	// the same event is received by every session attached to the topic
+	for range 10 {
+		tracker.track("grpA", "usrA", true)
+	}
+	tracker.track("grpA", "usrB", true)
+	tracker.track("grpA", "usrB", false)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		users, _, _ := store.Online("grpA")
+		if len(users) == 1 && users[0] == "usrA" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("online users = %v, want [usrA]", users)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.writes != 2 {
+		t.Errorf("store received %d writes, want 2", store.writes)
+	}
+}
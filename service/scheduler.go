@@ -0,0 +1,325 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/kv"
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// schedulerTick is how often the leader looks for due messages, the precision of send times
+	schedulerTick = time.Second
+	// leaderTTL is how long the leadership outlives a replica that stopped renewing it
+	leaderTTL = 10 * time.Second
+	// leaderKey holds the ID of the replica currently firing scheduled messages
+	leaderKey = "scheduler:leader"
+	// maxScheduledPerUser limits the pending scheduled messages of a single user
+	maxScheduledPerUser = 100
+	// dueBatchSize is the maximal number of messages fired in a single tick
+	dueBatchSize = 100
+	// sendingTimeout is how long a one-time message may stay claimed before it is considered lost,
+	// e.g. because the replica sending it died. Publishing times out well before.
+	sendingTimeout = 5 * requestTimeout
+	// sweepInterval is how often the leader looks for lost messages
+	sweepInterval = time.Minute
+)
+
+// errTooManyScheduled is returned when the user has too many pending scheduled messages
+var errTooManyScheduled = errors.New("too many scheduled messages")
+
+// ScheduleService stores messages to publish later and publishes them when they are due.
+// Every replica accepts scheduled messages, but only the elected leader publishes them.
+type ScheduleService struct {
+	jobs   *mongo.Collection
+	kv     kv.KeyValueStore
+	tinode *TinodeService
+	id     string // ID of this replica in leader election
+}
+
+// NewScheduleService creates a ScheduleService storing scheduled messages in the jobs collection
+func NewScheduleService(jobs *mongo.Collection, kv kv.KeyValueStore, tinode *TinodeService) *ScheduleService {
+	return &ScheduleService{jobs: jobs, kv: kv, tinode: tinode, id: uuid.NewString()}
+}
+
+// EnsureIndexes creates the indexes used to find due messages and the messages of a user
+func (s ScheduleService) EnsureIndexes(ctx context.Context) error {
+	_, err := s.jobs.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_run_at", Value: 1}}},
+		{Keys: bson.D{{Key: "user", Value: 1}, {Key: "next_run_at", Value: 1}}},
+	})
+	return err
+}
+
+// Schedule stores a message to be published to the topic on behalf of the user.
+// topic is the topic as addressed by the user, topicID the ID it is stored under.
+func (s ScheduleService) Schedule(ctx context.Context, userID models.UserID, topic, topicID string, form forms.ScheduledMessage) (job models.ScheduledMessage, err error) {
+	if s.tinode.root == nil {
+		return job, ErrUnavailable
+	}
+
+	// peer-to-peer topics are created by the first message, so only group topics are checked
+	if strings.HasPrefix(topicID, "grp") {
+		if err := s.tinode.checkAccess(ctx, userID, topicID, modeWrite); err != nil {
+			return job, err
+		}
+	}
+	if form.ReplyTo > 0 {
+		if _, err := s.tinode.threadRoot(ctx, topicID, form.ReplyTo); err != nil {
+			return job, err
+		}
+	}
+
+	pending, err := s.jobs.CountDocuments(ctx, bson.D{
+		{Key: "user", Value: userID},
+		{Key: "status", Value: models.ScheduledPending},
+	})
+	if err != nil {
+		return job, err
+	}
+	if pending >= maxScheduledPerUser {
+		return job, errTooManyScheduled
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	job = models.ScheduledMessage{
+		ID:        uuid.NewString(),
+		Author:    userID,
+		Topic:     topic,
+		TopicID:   topicID,
+		Content:   form.MessageContent(),
+		ReplyTo:   form.ReplyTo,
+		Cron:      form.Cron,
+		Status:    models.ScheduledPending,
+		CreatedAt: now,
+	}
+	if form.SendAt != nil {
+		sendAt := form.SendAt.UTC().Truncate(time.Millisecond)
+		job.SendAt = &sendAt
+		job.NextRunAt = sendAt
+	} else {
+		schedule, err := cron.ParseStandard(form.Cron)
+		if err != nil {
+			return job, err
+		}
+		job.NextRunAt = schedule.Next(now).UTC()
+	}
+
+	if _, err := s.jobs.InsertOne(ctx, job); err != nil {
+		return job, err
+	}
+	return job, nil
+}
+
+// List returns the scheduled messages of the user, the next to be published first
+func (s ScheduleService) List(ctx context.Context, userID models.UserID) ([]models.ScheduledMessage, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "next_run_at", Value: 1}})
+	cursor, err := s.jobs.Find(ctx, bson.D{{Key: "user", Value: userID}}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []models.ScheduledMessage{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Cancel deletes a scheduled message of the user, messages already published are not affected
+func (s ScheduleService) Cancel(ctx context.Context, userID models.UserID, id string) error {
+	res, err := s.jobs.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}, {Key: "user", Value: userID}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Run publishes due messages while this replica is the leader, until ctx is canceled
+func (s ScheduleService) Run(ctx context.Context) {
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+
+	leader := false
+	var lastSweep time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		elected, err := s.lead(leader)
+		if err != nil {
+			slog.Error("failed to renew scheduler leadership", "error", err)
+			elected = false
+		}
+		if elected != leader {
+			slog.Info("scheduler leadership changed", "leader", elected, "replica", s.id)
+			leader = elected
+		}
+		if leader {
+			if time.Since(lastSweep) >= sweepInterval {
+				s.failLost(ctx)
+				lastSweep = time.Now()
+			}
+			// the leadership is valid for leaderTTL since it was renewed, firing stops well before it expires
+			s.fireDue(ctx, time.Now().Add(leaderTTL/2))
+		}
+	}
+}
+
+// failLost marks one-time messages claimed longer than sendingTimeout ago as failed.
+// Whether they were published is unknown, they are not retried so they are published at most once.
+func (s ScheduleService) failLost(ctx context.Context) {
+	cutoff := time.Now().Add(-sendingTimeout)
+	res, err := s.jobs.UpdateMany(ctx, bson.D{
+		{Key: "status", Value: models.ScheduledSending},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "claimed_at", Value: bson.D{{Key: "$lt", Value: cutoff}}}},
+			// claimed before claims were timestamped
+			bson.D{{Key: "claimed_at", Value: bson.D{{Key: "$exists", Value: false}}}},
+		}},
+	}, bson.D{{Key: "$set", Value: bson.D{
+		{Key: "status", Value: models.ScheduledFailed},
+		{Key: "last_error", Value: "interrupted while sending, the message may not have been published"},
+	}}})
+	if err != nil {
+		slog.Error("failed to mark lost scheduled messages as failed", "error", err)
+		return
+	}
+	if res.ModifiedCount > 0 {
+		slog.Warn("marked lost scheduled messages as failed", "count", res.ModifiedCount)
+	}
+}
+
+// lead renews the leadership of this replica or tries to take it over, reports whether this replica leads
+func (s ScheduleService) lead(leader bool) (bool, error) {
+	if leader {
+		return s.kv.Refresh(leaderKey, s.id, leaderTTL)
+	}
+	return s.kv.SetNX(leaderKey, s.id, leaderTTL)
+}
+
+// fireDue publishes the messages that are due, until the deadline passes
+func (s ScheduleService) fireDue(ctx context.Context, deadline time.Time) {
+	now := time.Now()
+	opts := options.Find().SetSort(bson.D{{Key: "next_run_at", Value: 1}}).SetLimit(dueBatchSize)
+	cursor, err := s.jobs.Find(ctx, bson.D{
+		{Key: "status", Value: models.ScheduledPending},
+		{Key: "next_run_at", Value: bson.D{{Key: "$lte", Value: now}}},
+	}, opts)
+	if err != nil {
+		slog.Error("failed to find due scheduled messages", "error", err)
+		return
+	}
+
+	var jobs []models.ScheduledMessage
+	if err := cursor.All(ctx, &jobs); err != nil {
+		slog.Error("failed to read due scheduled messages", "error", err)
+		return
+	}
+
+	for _, job := range jobs {
+		if ctx.Err() != nil || time.Now().After(deadline) {
+			return
+		}
+		s.fire(ctx, job, now)
+	}
+}
+
+// fire claims the message and publishes it. The claim is atomic, so a message is published
+// at most once per run even if a former leader is still firing.
+func (s ScheduleService) fire(ctx context.Context, job models.ScheduledMessage, now time.Time) {
+	log := slog.With("id", job.ID, "user", job.Author, "topic", job.TopicID)
+
+	claim := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "status", Value: models.ScheduledSending},
+		{Key: "claimed_at", Value: now.UTC()},
+	}}}
+	if job.Cron != "" {
+		schedule, err := cron.ParseStandard(job.Cron)
+		if err != nil {
+			log.Error("invalid cron expression of scheduled message", "error", err, "cron", job.Cron)
+			return
+		}
+		// runs missed while no replica was leading are collapsed into this one
+		claim = bson.D{{Key: "$set", Value: bson.D{
+			{Key: "next_run_at", Value: schedule.Next(now).UTC()},
+			{Key: "last_run_at", Value: now.UTC()},
+		}}}
+	}
+
+	err := s.jobs.FindOneAndUpdate(ctx, bson.D{
+		{Key: "_id", Value: job.ID},
+		{Key: "status", Value: models.ScheduledPending},
+		{Key: "next_run_at", Value: job.NextRunAt},
+	}, claim).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// canceled or claimed by another replica in the meantime
+		return
+	}
+	if err != nil {
+		log.Error("failed to claim scheduled message", "error", err)
+		return
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	sendErr := s.publish(sendCtx, job)
+	cancel()
+
+	switch {
+	case errors.Is(sendErr, ErrForbidden):
+		// the author lost access to the topic, recurring messages are not sent anymore either
+		log.Warn("author can no longer publish scheduled message", "error", sendErr)
+		_, err = s.jobs.UpdateOne(ctx, bson.D{{Key: "_id", Value: job.ID}}, bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: models.ScheduledFailed},
+			{Key: "last_run_at", Value: now.UTC()},
+			{Key: "last_error", Value: sendErr.Error()},
+		}}})
+	case sendErr == nil && job.Cron == "":
+		_, err = s.jobs.DeleteOne(ctx, bson.D{{Key: "_id", Value: job.ID}})
+	case sendErr == nil:
+		_, err = s.jobs.UpdateOne(ctx, bson.D{{Key: "_id", Value: job.ID}},
+			bson.D{{Key: "$unset", Value: bson.D{{Key: "last_error", Value: ""}}}})
+	case job.Cron == "":
+		log.Warn("failed to publish scheduled message", "error", sendErr)
+		_, err = s.jobs.UpdateOne(ctx, bson.D{{Key: "_id", Value: job.ID}}, bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: models.ScheduledFailed},
+			{Key: "last_run_at", Value: now.UTC()},
+			{Key: "last_error", Value: sendErr.Error()},
+		}}})
+	default:
+		// recurring messages stay scheduled, the next run may succeed
+		log.Warn("failed to publish scheduled message", "error", sendErr)
+		_, err = s.jobs.UpdateOne(ctx, bson.D{{Key: "_id", Value: job.ID}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "last_error", Value: sendErr.Error()}}}})
+	}
+	if err != nil {
+		log.Error("failed to update scheduled message", "error", err)
+	}
+}
+
+// publish publishes the message on behalf of its author, who must still be allowed to write to the topic:
+// publishing attaches to the topic as the author, which would rejoin an author removed from a group
+func (s ScheduleService) publish(ctx context.Context, job models.ScheduledMessage) error {
+	if strings.HasPrefix(job.TopicID, "grp") {
+		if err := s.tinode.checkAccess(ctx, job.Author, job.TopicID, modeWrite); err != nil {
+			return err
+		}
+	}
+	return s.tinode.PublishAs(ctx, job.Author, job.Topic, job.TopicID, job.ReplyTo, job.Content)
+}
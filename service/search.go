@@ -0,0 +1,293 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"html"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// searchIndex is the name of the text index of message content
+const searchIndex = "content_text"
+
+// defaultSearchLimit is the page size of search results when the client does not specify one
+const defaultSearchLimit = 20
+
+// Snippets show up to snippetLength runes of the text, starting up to snippetContext runes before the first match
+const (
+	snippetLength  = 160
+	snippetContext = 40
+)
+
+// errInvalidCursor is returned for search cursors not issued by Search
+var errInvalidCursor = errors.New("invalid cursor")
+
+// EnsureSearchIndex creates the text index of message content used by Search, if it does not exist yet.
+// Plain text content is a string, Drafty content keeps its text in txt. Messages are written in any
+// language, so words are matched as they are, without stemming and stop words.
+func (s TinodeService) EnsureSearchIndex(ctx context.Context) error {
+	index := mongo.IndexModel{
+		Keys: bson.D{
+			bson.E{Key: "content", Value: "text"},
+			bson.E{Key: "content.txt", Value: "text"},
+		},
+		Options: options.Index().SetName(searchIndex).SetDefaultLanguage("none"),
+	}
+
+	if _, err := s.history.Collection("messages").Indexes().CreateOne(ctx, index); err != nil {
+		slog.Error("failed to create search index", "error", err)
+		return err
+	}
+	return nil
+}
+
+// readableTopics returns the topics the user is subscribed to with the read permission
+func (s TinodeService) readableTopics(ctx context.Context, userID models.UserID) ([]string, error) {
+	filter := bson.D{
+		bson.E{Key: "user", Value: strings.TrimPrefix(string(userID), "usr")},
+		bson.E{Key: "deletedat", Value: nil},
+	}
+	cursor, err := s.history.Collection("subscriptions").Find(ctx, filter)
+	if err != nil {
+		slog.Error("failed to fetch subscriptions", "error", err, "user", userID)
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var subs []struct {
+		Topic string `bson:"topic"`
+		Want  int64  `bson:"modewant"`
+		Given int64  `bson:"modegiven"`
+	}
+	if err := cursor.All(ctx, &subs); err != nil {
+		slog.Error("failed to fetch all subscriptions", "error", err)
+		return nil, err
+	}
+
+	topics := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		if sub.Want&sub.Given&modeRead != 0 && (strings.HasPrefix(sub.Topic, "grp") || strings.HasPrefix(sub.Topic, "p2p")) {
+			topics = append(topics, sub.Topic)
+		}
+	}
+	return topics, nil
+}
+
+// searchCursor encodes the position after the message in the search results
+func searchCursor(m models.Message) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(m.Timestamp.UnixMilli(), 10) + ":" + m.ID))
+}
+
+// parseSearchCursor decodes a cursor issued by searchCursor
+func parseSearchCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+	ms, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return time.Time{}, "", errInvalidCursor
+	}
+	millis, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+	return time.UnixMilli(millis), id, nil
+}
+
+// Search returns a page of messages matching the text search query, newest first.
+// Only topics the user may read are searched, topicID limits the search to a single topic.
+func (s TinodeService) Search(ctx context.Context, userID models.UserID, topicID string, author models.UserID, query forms.SearchQuery) (page models.SearchPage, err error) {
+	var topics []string
+	if topicID != "" {
+		if err := s.checkAccess(ctx, userID, topicID, modeRead); err != nil {
+			return page, err
+		}
+		topics = []string{topicID}
+	} else if topics, err = s.readableTopics(ctx, userID); err != nil {
+		return page, err
+	}
+	page.Results = []models.SearchResult{}
+	if len(topics) == 0 {
+		return page, nil
+	}
+
+	limit := query.Limit
+	if limit == 0 {
+		limit = defaultSearchLimit
+	}
+
+	filter := bson.D{
+		bson.E{Key: "$text", Value: bson.D{bson.E{Key: "$search", Value: query.Q}}},
+		bson.E{Key: "topic", Value: bson.D{bson.E{Key: "$in", Value: topics}}},
+	}
+	filter = append(filter, notEvents()...)
+	filter = append(filter, notDeleted(userID)...)
+	if author != "" {
+		filter = append(filter, bson.E{Key: "from", Value: strings.TrimPrefix(string(author), "usr")})
+	}
+	var sent bson.D
+	if !query.Since.IsZero() {
+		sent = append(sent, bson.E{Key: "$gte", Value: query.Since})
+	}
+	if !query.Until.IsZero() {
+		sent = append(sent, bson.E{Key: "$lt", Value: query.Until})
+	}
+	if len(sent) > 0 {
+		filter = append(filter, bson.E{Key: "createdat", Value: sent})
+	}
+	if query.Cursor != "" {
+		ts, id, err := parseSearchCursor(query.Cursor)
+		if err != nil {
+			return page, err
+		}
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{bson.E{Key: "createdat", Value: bson.D{bson.E{Key: "$lt", Value: ts}}}},
+			bson.D{bson.E{Key: "createdat", Value: ts}, bson.E{Key: "_id", Value: bson.D{bson.E{Key: "$lt", Value: id}}}},
+		}})
+	}
+
+	// one extra message tells whether there are more results
+	opts := options.Find().SetSort(bson.D{bson.E{Key: "createdat", Value: -1}, bson.E{Key: "_id", Value: -1}}).SetLimit(limit + 1)
+	cursor, err := s.history.Collection("messages").Find(ctx, filter, opts)
+	if err != nil {
+		slog.Error("failed to search messages", "error", err, "user", userID)
+		return page, err
+	}
+	defer cursor.Close(context.Background())
+
+	var messages []models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		slog.Error("failed to fetch all found messages", "error", err)
+		return page, err
+	}
+	if int64(len(messages)) > limit {
+		messages = messages[:limit]
+		next := searchCursor(messages[len(messages)-1])
+		page.NextCursor = &next
+	}
+
+	// edits and reactions are applied per topic, the order of the results is kept
+	byTopic := make(map[string][]models.Message)
+	for _, m := range messages {
+		byTopic[m.Topic] = append(byTopic[m.Topic], m)
+	}
+	current := make(map[string]models.Message, len(messages))
+	for topic, msgs := range byTopic {
+		if msgs, err = s.applyEdits(ctx, topic, msgs); err != nil {
+			return page, err
+		}
+		if err := s.applyReactions(ctx, topic, msgs); err != nil {
+			return page, err
+		}
+		renderMsgs(msgs)
+		for _, m := range msgs {
+			current[m.ID] = m
+		}
+	}
+
+	terms := searchTerms(query.Q)
+	for _, found := range messages {
+		m, ok := current[found.ID]
+		if !ok {
+			// retracted
+			continue
+		}
+		snippet, matched := highlight(m.Text, terms)
+		// the index holds the original text, edited messages must still match
+		if m.EditedAt != nil && !matched {
+			continue
+		}
+
+		topic := m.Topic
+		if peer, err := models.P2PPeer(m.Topic, userID); err == nil {
+			topic = string(peer)
+		}
+		page.Results = append(page.Results, models.SearchResult{Topic: topic, Message: m, Snippet: snippet})
+	}
+	return page, nil
+}
+
+// searchTerms returns the lowercase words of a text search query, excluded words are skipped
+func searchTerms(q string) []string {
+	var terms []string
+	for _, token := range strings.Fields(q) {
+		if strings.HasPrefix(token, "-") {
+			continue
+		}
+		for _, word := range strings.FieldsFunc(strings.ToLower(token), isNotWordRune) {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// isNotWordRune reports whether r separates words
+func isNotWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// highlight returns the HTML-escaped snippet of the text around the first word matching the terms,
+// matching words are wrapped in <mark>. Reports whether any word matched.
+func highlight(text string, terms []string) (string, bool) {
+	txt := []rune(text)
+
+	// words are compared rune by rune, so positions in the lowercase text match the original
+	var matches [][2]int
+	for start := 0; start < len(txt); {
+		if isNotWordRune(txt[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(txt) && !isNotWordRune(txt[end]) {
+			end++
+		}
+		word := strings.Map(unicode.ToLower, string(txt[start:end]))
+		for _, term := range terms {
+			if word == term {
+				matches = append(matches, [2]int{start, end})
+				break
+			}
+		}
+		start = end
+	}
+
+	from := 0
+	if len(matches) > 0 {
+		from = max(matches[0][0]-snippetContext, 0)
+	}
+	to := min(from+snippetLength, len(txt))
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := from
+	for _, m := range matches {
+		if m[0] < from || m[1] > to {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(txt[pos:m[0]])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(txt[m[0]:m[1]])))
+		b.WriteString("</mark>")
+		pos = m[1]
+	}
+	b.WriteString(html.EscapeString(string(txt[pos:to])))
+	if to < len(txt) {
+		b.WriteString("…")
+	}
+	return b.String(), len(matches) > 0
+}
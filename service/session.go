@@ -0,0 +1,452 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"github.com/google/uuid"
+	"github.com/tinode/chat/pbx"
+)
+
+// Session states, as reported by the health endpoint
+const (
+	StateConnected    = "connected"
+	StateReconnecting = "reconnecting"
+	StateClosed       = "closed"
+)
+
+const (
+	reconnectMinBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// typingInterval is the minimal interval between key press notifications of a user in a topic,
+// the same interval Tinode clients use
+const typingInterval = 3 * time.Second
+
+// session keeps a Tinode stream open on behalf of a single user (or the service itself).
+// Tinode authorizes per stream, not per request, so the service keeps one anonymous
+// session for account management and one session per logged-in user.
+// When the stream breaks, the session redials with exponential backoff and restores
+// its state: handshake, login and topic subscriptions.
+type session struct {
+	key     string // Hub key updates are published under, empty for anonymous sessions
+	client  pbx.NodeClient
+	hub     *Hub
+	restore func(ctx context.Context, r requester) error // Authenticates a freshly dialed stream, nil for anonymous sessions
+	typing  *throttle                                    // Throttles key press events forwarded to subscribers
+
+	mu    sync.RWMutex
+	conn  *conn // Current stream, nil while reconnecting
+	state string
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	lastUsed  atomic.Int64 // Unix nanoseconds of the last request, used for idle eviction
+}
+
+var _ requester = (*session)(nil)
+
+// newSession opens a new session to the Tinode server
+// ctx: Context bounding the initial handshake, the session itself outlives it
+// key: Hub key updates received by the session are published under
+// restore: Callback authenticating each new stream of the session, may be nil
+func newSession(ctx context.Context, client pbx.NodeClient, hub *Hub, key string, restore func(ctx context.Context, r requester) error) (*session, error) {
+	s := &session{
+		key:     key,
+		client:  client,
+		hub:     hub,
+		restore: restore,
+		typing:  newThrottle(typingInterval),
+		closed:  make(chan struct{}),
+	}
+	s.touch()
+
+	c, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.setConn(c, StateConnected)
+
+	go s.supervise(c)
+
+	return s, nil
+}
+
+// connect dials a new stream and prepares it for use: sends the initial handshake
+// and restores authentication and subscriptions
+func (s *session) connect(ctx context.Context) (*conn, error) {
+	c, err := dial(s.client, s.publish)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ping(ctx, c); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	if s.restore != nil {
+		if err := s.restore(ctx, c); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// supervise waits for the current stream to break and replaces it with a new one
+func (s *session) supervise(c *conn) {
+	for {
+		select {
+		case <-c.done:
+		case <-s.closed:
+			return
+		}
+		if s.isClosed() {
+			return
+		}
+
+		slog.Warn("lost connection to tinode, reconnecting", "error", c.err, "key", s.key)
+		s.setConn(nil, StateReconnecting)
+
+		if c = s.reconnect(); c == nil {
+			return
+		}
+		if !s.setConn(c, StateConnected) {
+			c.close()
+			return
+		}
+		slog.Info("reconnected to tinode", "key", s.key)
+	}
+}
+
+// reconnect dials new streams with exponential backoff until one succeeds.
+// Returns nil if the session is closed in the meantime, or closes the session and returns nil
+// if its credentials are rejected, as retrying can not succeed then.
+func (s *session) reconnect() *conn {
+	backoff := reconnectMinBackoff
+	for attempt := 1; ; attempt++ {
+		// jitter spreads reconnects of many sessions after a Tinode restart
+		wait := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-time.After(wait):
+		case <-s.closed:
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		c, err := s.connect(ctx)
+		cancel()
+		if err == nil {
+			return c
+		}
+		if isUnauthorized(err) {
+			slog.Warn("tinode session credentials rejected, closing session", "error", err, "key", s.key)
+			s.close()
+			if s.key != "" {
+				s.hub.Terminate(s.key, models.Event{Type: models.EventClose, What: "expired"})
+			}
+			return nil
+		}
+		slog.Error("failed to reconnect to tinode", "error", err, "key", s.key, "attempt", attempt)
+
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+// setConn replaces the current stream and state of the session.
+// Returns false if the session is already closed.
+func (s *session) setConn(c *conn, state string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() {
+		return false
+	}
+	s.conn = c
+	s.state = state
+	return true
+}
+
+// publish forwards an update to the session's hub subscribers
+func (s *session) publish(ev models.Event) {
+	if s.key == "" {
+		return
+	}
+	// a user typing in a topic produces a stream of key presses, subscribers need only a few of them
+	if ev.Type == models.EventInfo && ev.What == "kp" && !s.typing.allow(ev.Topic+":"+ev.From) {
+		return
+	}
+	s.hub.Publish(s.key, ev)
+}
+
+// send transmits a message through the current stream and waits for a response.
+// Fails with *ConnError while the session is reconnecting and with ErrSessionClosed once it is closed.
+func (s *session) send(ctx context.Context, rID string, msg *pbx.ClientMsg) (res any, err error) {
+	s.touch()
+
+	s.mu.RLock()
+	c := s.conn
+	s.mu.RUnlock()
+
+	if s.isClosed() {
+		return res, ErrSessionClosed
+	}
+	if c == nil {
+		return res, &ConnError{Err: errReconnecting}
+	}
+
+	res, err = c.send(ctx, rID, msg)
+	if err != nil && s.isClosed() {
+		return res, ErrSessionClosed
+	}
+	return res, err
+}
+
+// notify transmits a message the server does not respond to through the current stream
+func (s *session) notify(msg *pbx.ClientMsg) error {
+	s.touch()
+
+	s.mu.RLock()
+	c := s.conn
+	s.mu.RUnlock()
+
+	if s.isClosed() {
+		return ErrSessionClosed
+	}
+	if c == nil {
+		return &ConnError{Err: errReconnecting}
+	}
+
+	return c.notify(msg)
+}
+
+// State returns the connection state of the session
+func (s *session) State() string {
+	if s.isClosed() {
+		return StateClosed
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state
+}
+
+// touch marks the session as used now
+func (s *session) touch() {
+	s.lastUsed.Store(time.Now().UnixNano())
+}
+
+// idleSince returns the time of the last request sent through the session
+func (s *session) idleSince() time.Time {
+	return time.Unix(0, s.lastUsed.Load())
+}
+
+// isClosed reports whether the session was closed by the service
+func (s *session) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// close terminates the session and its current stream, the session is not reconnected afterwards
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		close(s.closed)
+		if s.conn != nil {
+			s.conn.close()
+			s.conn = nil
+		}
+	})
+}
+
+// login authenticates the stream with the given scheme ("basic" or "token")
+// Returns the user ID and the base64 encoded Tinode token issued by the server
+func login(ctx context.Context, r requester, scheme string, secret []byte) (userID models.UserID, token string, err error) {
+	rID := uuid.NewString()
+
+	req := &pbx.ClientMsg{Message: &pbx.ClientMsg_Login{
+		Login: &pbx.ClientLogin{
+			Id:     rID,
+			Scheme: scheme,
+			Secret: secret,
+		},
+	}}
+
+	rawres, err := r.send(ctx, rID, req)
+	if err != nil {
+		slog.Error("failed to send login message", "error", err, "id", rID)
+		return userID, token, err
+	}
+
+	res, err := ctrlResult(rID, rawres)
+	if err != nil {
+		return userID, token, err
+	}
+
+	// token is a JSON encoded byte slice, i.e. a quoted base64 string
+	var rawToken []byte
+	if err := json.Unmarshal(res.Params["token"], &rawToken); err != nil {
+		slog.Error("failed to parse token", "error", err, "id", rID)
+		return userID, token, err
+	}
+
+	userID = models.UserID(strings.Trim(string(res.Params["user"]), "\""))
+	return userID, base64.StdEncoding.EncodeToString(rawToken), nil
+}
+
+// loginToken authenticates the stream with a base64 encoded Tinode token
+func loginToken(ctx context.Context, r requester, token string) (models.UserID, error) {
+	secret, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+
+	userID, _, err := login(ctx, r, "token", secret)
+	return userID, err
+}
+
+// SessionManager keeps one authenticated Tinode session per logged-in user, keyed by access UUID.
+// Sessions are opened lazily using the Tinode token stored for the access UUID
+// and closed after being idle for a while or when the user logs out.
+type SessionManager struct {
+	client pbx.NodeClient
+	auth   *AuthService
+	hub    *Hub
+	idle   time.Duration
+
+	// setup prepares a freshly authenticated stream, e.g. subscribes it to the user's topics
+	setup func(ctx context.Context, r requester) error
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// NewSessionManager creates a SessionManager and starts evicting sessions idle for longer than idle
+func NewSessionManager(client pbx.NodeClient, auth *AuthService, hub *Hub, idle time.Duration, setup func(ctx context.Context, r requester) error) *SessionManager {
+	m := &SessionManager{
+		client:   client,
+		auth:     auth,
+		hub:      hub,
+		idle:     idle,
+		setup:    setup,
+		sessions: make(map[string]*session),
+	}
+
+	go m.evictIdle()
+
+	return m
+}
+
+// Get returns the session of the given access UUID, opening a new one if needed
+func (m *SessionManager) Get(ctx context.Context, accessUUID string) (*session, error) {
+	m.mu.Lock()
+	s, ok := m.sessions[accessUUID]
+	m.mu.Unlock()
+
+	if ok && !s.isClosed() {
+		s.touch()
+		return s, nil
+	}
+
+	s, err := newSession(ctx, m.client, m.hub, accessUUID, func(ctx context.Context, r requester) error {
+		// the token is fetched on every (re)connect, so a session of a logged out user cannot come back
+		token, err := m.auth.FetchTinodeToken(accessUUID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := loginToken(ctx, r, token); err != nil {
+			return err
+		}
+
+		return m.setup(ctx, r)
+	})
+	if err != nil {
+		slog.Error("failed to open session", "error", err, "access_uuid", accessUUID)
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// another request might have opened a session concurrently, keep only one of them
+	if existing, ok := m.sessions[accessUUID]; ok && !existing.isClosed() {
+		s.close()
+		return existing, nil
+	}
+	m.sessions[accessUUID] = s
+	slog.Info("opened session", "access_uuid", accessUUID)
+
+	return s, nil
+}
+
+// Close terminates the session of the given access UUID, if any, and disconnects its realtime
+// clients, so they log in again instead of waiting for updates that will never come
+func (m *SessionManager) Close(accessUUID string) {
+	m.mu.Lock()
+	s, ok := m.sessions[accessUUID]
+	delete(m.sessions, accessUUID)
+	m.mu.Unlock()
+
+	if ok {
+		s.close()
+		slog.Info("closed session", "access_uuid", accessUUID)
+	}
+	m.hub.Terminate(accessUUID, models.Event{Type: models.EventClose, What: "revoked"})
+}
+
+// Stats returns the number of open user sessions and how many of them are reconnecting
+func (m *SessionManager) Stats() (open, reconnecting int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.sessions {
+		open++
+		if s.State() == StateReconnecting {
+			reconnecting++
+		}
+	}
+	return open, reconnecting
+}
+
+// evictIdle periodically closes sessions idle for longer than m.idle.
+// Sessions with connected realtime subscribers are never considered idle.
+func (m *SessionManager) evictIdle() {
+	ticker := time.NewTicker(m.idle / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var evicted []*session
+
+		m.mu.Lock()
+		for key, s := range m.sessions {
+			if s.isClosed() || (time.Since(s.idleSince()) > m.idle && !m.hub.HasSubscribers(key)) {
+				delete(m.sessions, key)
+				evicted = append(evicted, s)
+			}
+		}
+		m.mu.Unlock()
+
+		for _, s := range evicted {
+			s.close()
+			slog.Info("evicted idle session", "access_uuid", s.key)
+		}
+	}
+}
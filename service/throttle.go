@@ -0,0 +1,44 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// throttleSweepSize is the number of tracked keys above which expired keys are forgotten
+const throttleSweepSize = 1024
+
+// throttle admits at most one event per key within the interval
+type throttle struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time // Time each key was last admitted
+}
+
+func newThrottle(interval time.Duration) *throttle {
+	return &throttle{interval: interval, last: make(map[string]time.Time)}
+}
+
+// allow reports whether an event with the key may pass now, and records it if so
+func (t *throttle) allow(key string) bool {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if last, ok := t.last[key]; ok && now.Sub(last) < t.interval {
+		return false
+	}
+	t.last[key] = now
+
+	// keys are never removed otherwise, so the map would keep every key ever seen
+	if len(t.last) > throttleSweepSize {
+		for k, ts := range t.last {
+			if now.Sub(ts) >= t.interval {
+				delete(t.last, k)
+			}
+		}
+	}
+	return true
+}
@@ -5,11 +5,10 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"log/slog"
+	"slices"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/dartt0n/realtime-chat-backend/forms"
 	"github.com/dartt0n/realtime-chat-backend/kv"
@@ -26,116 +25,108 @@ import (
 // TinodeService handles communication with the Tinode chat server
 // It manages user authentication, message passing and server updates
 type TinodeService struct {
-	kv     kv.KeyValueStore           // Key-value store for persistent data
-	client pbx.NodeClient             // gRPC client for Tinode server
-	stream pbx.Node_MessageLoopClient // Bi-directional message stream
-
-	auth   *AuthService
-	topic  models.Topic
-	reqres *sync.Map // Maps request IDs to response channels
-
-	mongouri string
-	mongodb  string
+	kv       kv.KeyValueStore // Key-value store for persistent data
+	client   pbx.NodeClient   // gRPC client for Tinode server
+	sys      *session         // Anonymous session used for account registration
+	root     *session         // Session of a Tinode root user acting on behalf of users, nil if not configured
+	sessions *SessionManager  // Authenticated sessions of logged-in users
+
+	auth     *AuthService
+	hub      *Hub             // Fans out realtime updates to connected clients
+	typing   *throttle        // Throttles key press notifications sent by users
+	presence PresenceStore    // Users online in each topic
+	tracker  *presenceTracker // Applies presence events to the presence store
+	topic    models.Topic
+
+	history *mongo.Database // Tinode database, read from secondaries when configured
 }
 
 // NewTinodeService creates a new TinodeService instance
 // addr: Tinode server address (e.g. "localhost:6061")
 // kv: Key-value store implementation
 // auth: Authentication service instance
-func NewTinodeService(addr string, generalTopic models.Topic, mongouri, mongodb string, kv kv.KeyValueStore, auth *AuthService) (*TinodeService, error) {
+// hub: Hub receiving realtime updates from the server
+// presence: Store of the users online in each topic, fed by presence updates
+// sessionIdle: time after which unused user sessions are closed
+// rootSecret: "login:password" of a Tinode root user, empty disables actions taken without a user session
+func NewTinodeService(addr string, generalTopic models.Topic, history *mongo.Database, kv kv.KeyValueStore, auth *AuthService, hub *Hub, presence PresenceStore, sessionIdle time.Duration, rootSecret string) (*TinodeService, error) {
 	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		return nil, err
 	}
 
 	client := pbx.NewNodeClient(conn)
-	stream, err := client.MessageLoop(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	sys, err := newSession(ctx, client, hub, "", nil)
 	if err != nil {
 		return nil, err
 	}
 
+	var root *session
+	if rootSecret != "" {
+		root, err = newSession(ctx, client, hub, "", func(ctx context.Context, r requester) error {
+			_, _, err := login(ctx, r, "basic", []byte(rootSecret))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	s := &TinodeService{
 		kv:       kv,
 		client:   client,
-		stream:   stream,
+		sys:      sys,
+		root:     root,
 		auth:     auth,
+		hub:      hub,
+		typing:   newThrottle(typingInterval),
+		presence: presence,
+		tracker:  newPresenceTracker(presence),
 		topic:    generalTopic,
-		reqres:   &sync.Map{},
-		mongouri: mongouri,
-		mongodb:  mongodb,
-	}
-
-	go s.ListenUpdates()
-
-	// Send initial handshake message
-	if err := s.ping(); err != nil {
-		return nil, err
+		history:  history,
 	}
+	s.sessions = NewSessionManager(client, auth, hub, sessionIdle, s.setupSession)
+	hub.Observe(s.trackPresence)
+	auth.OnRevoke(s.sessions.Close)
 
 	return s, nil
 }
 
-// ListenUpdates handles incoming messages from the Tinode server
-// It processes different types of messages (control, data, presence etc.)
-// and routes responses to the appropriate request handlers
-func (s TinodeService) ListenUpdates() {
-	for {
-		msg, err := s.stream.Recv()
-		if err != nil {
-			slog.Error("failed to receive message", "error", err)
-			return
-		}
-
-		switch m := msg.Message.(type) {
-		case *pbx.ServerMsg_Ctrl:
-			slog.Info("received control message", "code", m.Ctrl.Code, "msg", m.Ctrl.Text)
-
-			// Route control message to waiting request handler if one exists
-			if ch, ok := s.reqres.Load(m.Ctrl.Id); ok {
-				ch.(chan any) <- m
-			} else {
-				slog.Warn("received unawaited control message", "code", m.Ctrl.Code, "msg", m.Ctrl.Text, "id", m.Ctrl.Id)
-			}
-		case *pbx.ServerMsg_Data:
-			slog.Info("received data message", "topic", m.Data.Topic, "msg", "<bytes>", "length", len(m.Data.Content))
-		case *pbx.ServerMsg_Pres:
-			slog.Info("received presence message", "topic", m.Pres.Topic, "msg", m.Pres.What.String())
-		case *pbx.ServerMsg_Meta:
-			slog.Info("received metadata message", "topic", m.Meta.Topic, "msg", m.Meta.Desc)
-
-			// Route meta message to waiting request handler if one exists
-			if ch, ok := s.reqres.Load(m.Meta.Id); ok {
-				ch.(chan any) <- m
-			} else {
-				slog.Warn("received unawaited meta message", "topic", m.Meta.Topic, "msg", m.Meta.Desc)
-			}
-		case *pbx.ServerMsg_Info:
-			slog.Info("received info message", "topic", m.Info.Topic, "msg", m.Info.What.String())
-		default:
-			slog.Error("received unknown message", "message", msg)
+// MessageEvent converts a stored message into a realtime data event,
+// so replayed history looks the same as live updates
+func MessageEvent(topic string, m models.Message) models.Event {
+	content, _ := json.Marshal(m.Content)
+	ts := m.Timestamp
+	ev := models.Event{
+		Type:      models.EventData,
+		Topic:     topic,
+		From:      "usr" + m.Author,
+		SeqID:     m.SeqID,
+		Content:   content,
+		Timestamp: &ts,
+	}
+	// edits, reactions and replies are told apart by their head
+	if len(m.Head) > 0 {
+		ev.Head = make(map[string]json.RawMessage, len(m.Head))
+		for k, v := range m.Head {
+			ev.Head[k], _ = json.Marshal(v)
 		}
 	}
+	return ev
 }
 
-// ping sends a Hi message to the server and waits for a response
-func (s TinodeService) ping() error {
-	rID := uuid.NewString()
-	_, err := s.send(rID, &pbx.ClientMsg{Message: &pbx.ClientMsg_Hi{
-		Hi: &pbx.ClientHi{
-			Id:        rID,
-			UserAgent: "golang/1.0",
-			Ver:       "0.22.13",
-			Lang:      "EN",
-		},
-	}})
-
-	return err
+// Topic returns the general topic all users are joined to
+func (s TinodeService) Topic() models.Topic {
+	return s.topic
 }
 
 // CreateUser registers a new user with the Tinode server
 // form: Registration form containing email and password
 // Returns the created user model and any error
-func (s TinodeService) CreateUser(form forms.RegisterForm) (user models.User, err error) {
+func (s TinodeService) CreateUser(ctx context.Context, form forms.RegisterForm) (user models.User, err error) {
 	rID := uuid.NewString()
 	username := generateUsername(form.Email)
 
@@ -162,35 +153,26 @@ func (s TinodeService) CreateUser(form forms.RegisterForm) (user models.User, er
 			Login:  false,
 			Tags:   []string{},
 			Desc: &pbx.SetDesc{
-				DefaultAcs: &pbx.DefaultAcsMode{
-					Auth: "JRWPA",
-					Anon: "N",
-				},
-				Public:  publicPayload,
-				Private: privatePayload,
+				DefaultAcs: defaultAcs(defaultAccess),
+				Public:     publicPayload,
+				Private:    privatePayload,
 			},
 		},
 	}}
 	slog.Debug("sending account registration message", "id", rID, "msg", req)
 
-	rawres, err := s.send(rID, req)
+	rawres, err := s.sys.send(ctx, rID, req)
 	if err != nil {
 		slog.Error("failed to send account registration message", "error", err, "id", rID)
 		return user, err
 	}
 
-	res, ok := rawres.(*pbx.ServerMsg_Ctrl)
-	if !ok {
-		slog.Error("failed to project type to ServerMsg_Ctrl", "id", rID, "res", rawres)
-		return user, errors.New("unexpected response from event loop")
-	}
-	slog.Debug("received response from event loop", "res", res)
-
-	if res.Ctrl.Code != 201 {
-		return user, errors.New("unexpected response code")
+	res, err := ctrlResult(rID, rawres)
+	if err != nil {
+		return user, err
 	}
 
-	user.ID = models.UserID(strings.Trim(string(res.Ctrl.Params["user"]), "\""))
+	user.ID = models.UserID(strings.Trim(string(res.Params["user"]), "\""))
 	user.Email = form.Email
 	user.Password = form.Password
 
@@ -199,230 +181,410 @@ func (s TinodeService) CreateUser(form forms.RegisterForm) (user models.User, er
 
 // Login authenticates a user with the Tinode server
 // form: Login form containing email and password
+// client: Client the login comes from, listed with the user's sessions
 // Returns the user model, authentication tokens and any error
-func (s TinodeService) Login(form forms.LoginForm) (user models.User, token models.Token, err error) {
-	rID := uuid.NewString()
+func (s TinodeService) Login(ctx context.Context, form forms.LoginForm, client models.ClientInfo) (user models.User, token models.Token, err error) {
 	username := generateUsername(form.Email)
 
-	req := &pbx.ClientMsg{Message: &pbx.ClientMsg_Login{
-		Login: &pbx.ClientLogin{
-			Id:     rID,
-			Scheme: "basic",
-			Secret: []byte(username + ":" + form.Password),
-		},
-	}}
-
-	rawres, err := s.send(rID, req)
+	// a Tinode session can be authenticated only once, so the credentials are exchanged
+	// for a Tinode token on a short-lived session, and the user's own session is opened with the token
+	loginSess, err := newSession(ctx, s.client, s.hub, "", nil)
 	if err != nil {
-		slog.Error("failed to send login message", "error", err, "id", rID)
+		slog.Error("failed to open login session", "error", err)
 		return user, token, err
 	}
+	defer loginSess.close()
 
-	res, ok := rawres.(*pbx.ServerMsg_Ctrl)
-	if !ok {
-		slog.Error("failed to project type to ServerMsg_Ctrl", "id", rID, "res", rawres)
-		return user, token, errors.New("unexpected response from event loop")
+	userID, tinodeToken, err := login(ctx, loginSess, "basic", []byte(username+":"+form.Password))
+	if err != nil {
+		return user, token, err
 	}
-	slog.Debug("received response from event loop", "res", res)
-
-	if res.Ctrl.Code != 200 {
-		slog.Error("unexpected response code", "code", res.Ctrl.Code, "res", res)
-		return user, token, errors.New("unexpected response code")
+	// checked after the password, so the response does not reveal unverified accounts
+	if verificationPending(s.kv, userID) {
+		return user, token, ErrEmailNotVerified
 	}
 
-	td, err := s.auth.CreateToken(models.UserID(strings.Trim(string(res.Ctrl.Params["user"]), "\"")))
+	td, err := s.auth.CreateToken(userID, "")
 	if err != nil {
 		slog.Error("failed to create token", "error", err)
 		return user, token, err
 	}
 
-	err = s.auth.CreateAuth(models.UserID(strings.Trim(string(res.Ctrl.Params["user"]), "\"")), td)
+	err = s.auth.CreateAuth(userID, td, client)
 	if err != nil {
 		slog.Error("failed to create auth", "error", err)
 		return user, token, err
 	}
 
-	token.AccessToken = td.AccessToken
-	token.RefreshToken = td.RefreshToken
-
-	s.kv.Set(td.AccessUUID+":token", string(res.Ctrl.Params["token"]), 0)
+	err = s.auth.CreateTinodeToken(td, tinodeToken)
+	if err != nil {
+		slog.Error("failed to store tinode token", "error", err)
+		return user, token, err
+	}
 
-	if err := s.joinTopic(s.topic.ID); err != nil {
-		slog.Error("failed to join topic", "error", err)
+	// open the session right away, so the user is subscribed to the general topic
+	if _, err := s.sessions.Get(ctx, td.AccessUUID); err != nil {
+		slog.Error("failed to open user session", "error", err)
 		return user, token, err
 	}
 
-	user.ID = models.UserID(strings.Trim(string(res.Ctrl.Params["user"]), "\""))
+	token.AccessToken = td.AccessToken
+	token.RefreshToken = td.RefreshToken
+
+	user.ID = userID
 	user.Email = form.Email
 	user.Password = form.Password
 	return user, token, nil
 }
 
-func (s TinodeService) FetchLastMsgs() ([]models.Message, error) {
-	conn, err := mongo.Connect(options.Client().ApplyURI(s.mongouri))
-	if err != nil {
+// Health reports the state of the service's own Tinode session and of the user sessions
+func (s TinodeService) Health() models.TinodeHealth {
+	open, reconnecting := s.sessions.Stats()
+	return models.TinodeHealth{
+		State:        s.sys.State(),
+		Sessions:     open,
+		Reconnecting: reconnecting,
+	}
+}
+
+// Subscribe opens (or reuses) the user's session and subscribes to its realtime updates.
+// The session stays open as long as the subscription is not closed.
+func (s TinodeService) Subscribe(ctx context.Context, accessUUID string) (*Subscription, error) {
+	if _, err := s.sessions.Get(ctx, accessUUID); err != nil {
 		return nil, err
 	}
-	defer conn.Disconnect(context.Background())
 
-	db := conn.Database(s.mongodb)
+	return s.hub.Subscribe(accessUUID), nil
+}
+
+// setupSession subscribes a freshly authenticated user stream to the general topic
+// and attaches it to every other topic the user is subscribed to, so it receives their updates
+func (s TinodeService) setupSession(ctx context.Context, r requester) error {
+	// subscriptions of the user are listed through the "me" topic
+	if err := attachTopic(ctx, r, "me"); err != nil {
+		return err
+	}
 
-	cursor, err := db.Collection("messages").Find(context.Background(), bson.D{bson.E{Key: "topic", Value: s.topic.ID}}, options.Find().SetSort(bson.D{bson.E{Key: "seq_id", Value: -1}}).SetLimit(50))
+	if err := s.joinTopic(ctx, r, s.topic.ID); err != nil {
+		return err
+	}
+
+	subs, err := topicSubs(ctx, r, "me")
 	if err != nil {
-		slog.Error("failed to fetch last messages", "error", err)
-		return nil, err
+		return err
+	}
+
+	for _, sub := range subs {
+		// peer-to-peer topics are listed under the ID of the other user
+		if sub.Topic == s.topic.ID || !(strings.HasPrefix(sub.Topic, "grp") || strings.HasPrefix(sub.Topic, "usr")) {
+			continue
+		}
+		// a single broken topic must not lock the user out of all the others
+		if err := attachTopic(ctx, r, sub.Topic); err != nil {
+			slog.Error("failed to attach to topic", "error", err, "topic", sub.Topic)
+		}
+	}
+
+	return nil
+}
+
+// defaultHistoryLimit is the page size of message history when the client does not specify one
+const defaultHistoryLimit = 50
+
+// FetchMsgs returns a page of the topic history, ordered from newest to oldest.
+// Without cursors the page holds the latest messages. With `before` it holds the messages right
+// before the cursor, with only `after` the messages right after it.
+// Replies are not a part of the history, their count is shown on the messages they reply to.
+// Returns ErrForbidden if the user is not allowed to read the topic.
+func (s TinodeService) FetchMsgs(ctx context.Context, userID models.UserID, topicID string, query forms.HistoryQuery) (page models.MessagePage, err error) {
+	if err := s.checkAccess(ctx, userID, topicID, modeRead); err != nil {
+		return page, err
+	}
+
+	filter := append(visibleMsgs(topicID, userID), bson.E{Key: "head." + headReply, Value: bson.D{bson.E{Key: "$exists", Value: false}}})
+	page, err = s.fetchPage(ctx, topicID, filter, query)
+	if err != nil {
+		return page, err
+	}
+	if err := s.applyThreads(ctx, userID, topicID, page.Messages); err != nil {
+		return page, err
+	}
+	return page, nil
+}
+
+// fetchPage returns a page of the topic's messages matching the filter, see FetchMsgs for paging
+func (s TinodeService) fetchPage(ctx context.Context, topicID string, filter bson.D, query forms.HistoryQuery) (page models.MessagePage, err error) {
+	limit := query.Limit
+	if limit == 0 {
+		limit = defaultHistoryLimit
+	}
+
+	seqRange := bson.D{}
+	if query.Before > 0 {
+		seqRange = append(seqRange, bson.E{Key: "$lt", Value: query.Before})
+	}
+	if query.After > 0 {
+		seqRange = append(seqRange, bson.E{Key: "$gt", Value: query.After})
+	}
+	if len(seqRange) > 0 {
+		filter = append(filter, bson.E{Key: "seqid", Value: seqRange})
+	}
+
+	// paging forward walks the history from the cursor up, every other query walks it down
+	forward := query.After > 0 && query.Before == 0
+	order := -1
+	if forward {
+		order = 1
+	}
+
+	// one extra message tells whether there is anything beyond the page
+	opts := options.Find().SetSort(bson.D{bson.E{Key: "seqid", Value: order}}).SetLimit(limit + 1)
+	cursor, err := s.history.Collection("messages").Find(ctx, filter, opts)
+	if err != nil {
+		slog.Error("failed to fetch messages", "error", err, "topic", topicID, "before", query.Before, "after", query.After)
+		return page, err
 	}
 	defer cursor.Close(context.Background())
 
 	var messages []models.Message
-	if err := cursor.All(context.Background(), &messages); err != nil {
+	if err := cursor.All(ctx, &messages); err != nil {
 		slog.Error("failed to fetch all messages", "error", err)
-		return nil, err
+		return page, err
+	}
+
+	more := int64(len(messages)) > limit
+	if more {
+		messages = messages[:limit]
+	}
+	if forward {
+		slices.Reverse(messages)
+	}
+	page.Messages = []models.Message{}
+	if len(messages) == 0 {
+		return page, nil
+	}
+
+	// cursors are taken before edits are applied, retracted messages may leave the page short
+	newest, oldest := messages[0].SeqID, messages[len(messages)-1].SeqID
+	// paging forward starts after an older message, paging backward before a newer one,
+	// the extra message tells whether the history continues in the direction of paging
+	if forward || more {
+		page.NextCursor = &oldest
+	}
+	if (forward && more) || query.Before > 0 {
+		page.PrevCursor = &newest
+	}
+
+	page.Messages, err = s.applyEdits(ctx, topicID, messages)
+	if err != nil {
+		return page, err
+	}
+	if err := s.applyReactions(ctx, topicID, page.Messages); err != nil {
+		return page, err
+	}
+	renderMsgs(page.Messages)
+
+	return page, nil
+}
+
+// FetchMsgsSince returns up to limit messages of the general topic with seq ID greater than seqID,
+// ordered from oldest to newest. It is used to replay messages missed by reconnecting clients:
+// like FetchMsgs it skips messages deleted for the user and applies edits.
+// more reports that the limit left newer messages out.
+func (s TinodeService) FetchMsgsSince(ctx context.Context, userID models.UserID, seqID int32, limit int64) (messages []models.Message, more bool, err error) {
+	filter := append(visibleMsgs(s.topic.ID, userID), bson.E{Key: "seqid", Value: bson.D{bson.E{Key: "$gt", Value: seqID}}})
+	// one extra message tells whether there is anything beyond the limit
+	opts := options.Find().SetSort(bson.D{bson.E{Key: "seqid", Value: 1}}).SetLimit(limit + 1)
+	cursor, err := s.history.Collection("messages").Find(ctx, filter, opts)
+	if err != nil {
+		slog.Error("failed to fetch messages since seq id", "error", err, "seq_id", seqID)
+		return nil, false, err
+	}
+	defer cursor.Close(ctx)
+
+	if err := cursor.All(ctx, &messages); err != nil {
+		slog.Error("failed to fetch all messages", "error", err)
+		return nil, false, err
+	}
+
+	more = int64(len(messages)) > limit
+	if more {
+		messages = messages[:limit]
+	}
+	messages, err = s.applyEdits(ctx, s.topic.ID, messages)
+	if err != nil {
+		return nil, false, err
+	}
+	return messages, more, nil
+}
+
+// SendMessage publishes a message to the topic on behalf of the user.
+// replyTo is the seq ID of the message replied to, zero for messages outside of threads.
+func (s TinodeService) SendMessage(ctx context.Context, accessUUID, topicID string, replyTo int32, content models.Content) error {
+	return s.sendMessage(ctx, accessUUID, topicID, topicID, replyTo, content)
+}
+
+// sendMessage publishes a message to the topic addressed as pubTopic by the session,
+// it differs from topicID for peer-to-peer topics
+func (s TinodeService) sendMessage(ctx context.Context, accessUUID, pubTopic, topicID string, replyTo int32, content models.Content) error {
+	head, raw, err := s.messagePayload(ctx, topicID, replyTo, content)
+	if err != nil {
+		return err
+	}
+	return s.publish(ctx, accessUUID, pubTopic, head, raw)
+}
+
+// messagePayload returns the head and the encoded content of a message, replies refer to the root of the thread
+func (s TinodeService) messagePayload(ctx context.Context, topicID string, replyTo int32, content models.Content) (map[string][]byte, []byte, error) {
+	head := contentHead(nil, content)
+	if replyTo > 0 {
+		root, err := s.threadRoot(ctx, topicID, replyTo)
+		if err != nil {
+			return nil, nil, err
+		}
+		ref, err := json.Marshal(seqRef(root))
+		if err != nil {
+			return nil, nil, err
+		}
+		if head == nil {
+			head = make(map[string][]byte, 1)
+		}
+		head[headReply] = ref
 	}
 
-	return messages, nil
+	raw, err := json.Marshal(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	return head, raw, nil
 }
 
-func (s TinodeService) SendMessage(accessUUID, content string) error {
+// contentHead adds the head keys Tinode clients need to interpret the content to head
+func contentHead(head map[string][]byte, content models.Content) map[string][]byte {
+	if content.Drafty == nil {
+		return head
+	}
+	if head == nil {
+		head = make(map[string][]byte, 1)
+	}
+	head[headMIME] = []byte(`"` + draftyMIME + `"`)
+	return head
+}
+
+// publish sends a message with the given head and content to the topic on behalf of the user
+func (s TinodeService) publish(ctx context.Context, accessUUID, topicID string, head map[string][]byte, content []byte) error {
 	rID := uuid.NewString()
 
-	// if err := s.switchUser(accessUUID); err != nil {
-	// 	return err
-	// }
+	sess, err := s.sessions.Get(ctx, accessUUID)
+	if err != nil {
+		return err
+	}
 
 	msg := &pbx.ClientMsg{
 		Message: &pbx.ClientMsg_Pub{
 			Pub: &pbx.ClientPub{
 				Id:      rID,
-				Topic:   s.topic.ID,
-				Content: []byte(fmt.Sprintf(`"%s"`, content)),
+				Topic:   topicID,
+				Head:    head,
+				Content: content,
 				NoEcho:  false,
 			},
 		},
 	}
 
-	res, err := s.send(rID, msg)
+	rawres, err := sess.send(ctx, rID, msg)
 	if err != nil {
 		return err
 	}
 
-	if res.(*pbx.ServerMsg_Ctrl).Ctrl.Code/100 != 2 {
-		return errors.New("unexpected response code")
-	}
-
-	return nil
+	_, err = ctrlResult(rID, rawres)
+	return err
 }
 
-// declareReq creates a new response channel for a request ID
-func (s TinodeService) declareReq(rID string) error {
-	if _, ok := s.reqres.Load(rID); ok {
-		return errors.New("dublicate request id")
+// PublishAs publishes a message on behalf of the user through the root session, so the user needs no session of its own.
+// pubTopic is the topic as addressed by the user, it differs from topicID for peer-to-peer topics.
+// Returns ErrUnavailable if no root user is configured.
+func (s TinodeService) PublishAs(ctx context.Context, userID models.UserID, pubTopic, topicID string, replyTo int32, content models.Content) error {
+	if s.root == nil {
+		return ErrUnavailable
 	}
-	// unfortunately, go type system doesn't allow us to create discriminated unions, so we have to use any (interface{})
-	s.reqres.Store(rID, make(chan any, 1))
-	slog.Debug("declared request", "id", rID)
 
-	return nil
-}
+	head, raw, err := s.messagePayload(ctx, topicID, replyTo, content)
+	if err != nil {
+		return err
+	}
 
-// revokeReq removes a response channel for a request ID
-func (s TinodeService) revokeReq(rID string) error {
-	ch, ok := s.reqres.LoadAndDelete(rID)
-	if !ok {
-		return errors.New("request not found")
+	// the root session is attached to the topic as the user only for the duration of the publication
+	rID := uuid.NewString()
+	rawres, err := s.rootSend(ctx, userID, rID, &pbx.ClientMsg{Message: &pbx.ClientMsg_Sub{
+		Sub: &pbx.ClientSub{Id: rID, Topic: pubTopic},
+	}})
+	if err != nil {
+		return err
 	}
-	close(ch.(chan any))
-	slog.Debug("revoked request", "id", rID)
-	return nil
-}
+	if _, err := subResult(rID, rawres); err != nil {
+		return err
+	}
+	defer s.leaveAs(userID, pubTopic)
 
-// send transmits a message to the Tinode server and waits for a response
-// rID: Request ID for tracking the response
-// msg: Message to send
-// Returns the server response and any error
-func (s TinodeService) send(rID string, msg *pbx.ClientMsg) (res any, err error) {
-	err = s.declareReq(rID)
+	rID = uuid.NewString()
+	rawres, err = s.rootSend(ctx, userID, rID, &pbx.ClientMsg{Message: &pbx.ClientMsg_Pub{
+		Pub: &pbx.ClientPub{Id: rID, Topic: pubTopic, Head: head, Content: raw},
+	}})
 	if err != nil {
-		slog.Error("failed to declare request", "error", err, "id", rID)
-		return res, err
+		return err
 	}
+	_, err = ctrlResult(rID, rawres)
+	return err
+}
 
-	defer func() {
-		err := s.revokeReq(rID)
-		if err != nil {
-			slog.Error("failed to revoke request", "error", err, "id", rID)
-		}
-	}()
+// leaveAs detaches the root session from the topic it was attached to as the user, keeping the user's subscription
+func (s TinodeService) leaveAs(userID models.UserID, topic string) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
 
-	slog.Debug("sending message", "id", rID, "msg", msg)
-	err = s.stream.Send(msg)
-	if err != nil {
-		slog.Error("failed to send account registration message", "error", err, "id", rID)
-		return res, err
+	rID := uuid.NewString()
+	rawres, err := s.rootSend(ctx, userID, rID, &pbx.ClientMsg{Message: &pbx.ClientMsg_Leave{
+		Leave: &pbx.ClientLeave{Id: rID, Topic: topic},
+	}})
+	if err == nil {
+		_, err = ctrlResult(rID, rawres)
 	}
-	slog.Debug("awaiting for response", "id", rID)
-	ch, ok := s.reqres.Load(rID)
-	if !ok {
-		return res, errors.New("internal error")
+	if err != nil {
+		slog.Warn("failed to leave topic", "error", err, "topic", topic, "user", userID)
 	}
+}
 
-	// Wait for response from event loop
-	res = <-ch.(chan any)
-	slog.Debug("received response", "res", res)
-
-	return res, nil
+// rootSend sends the message through the root session on behalf of the user
+func (s TinodeService) rootSend(ctx context.Context, userID models.UserID, rID string, msg *pbx.ClientMsg) (any, error) {
+	msg.OnBehalfOf = string(userID)
+	return s.root.send(ctx, rID, msg)
 }
 
 // generateUsername creates a unique username from an email address
 // Format: localpart_pr_hash where:
 // - localpart is the part before @ in email
-// - pr is first 2 chars of provider name
+// - pr is first 2 chars of provider name, or fewer if the name is shorter
 // - hash is first 8 chars of MD5 hash of full email
 // Example: john_gm_5d41402a for john@gmail.com
 func generateUsername(email string) string {
 	email = strings.ToLower(strings.Trim(email, " \n\r\t"))
 
-	prefix := strings.Split(email, "@")[0]
-	provider := strings.Split(strings.Split(email, "@")[1], ".")[0][:2]
+	parts := strings.Split(email, "@")
+	prefix := parts[0]
+	provider := ""
+	if len(parts) > 1 {
+		provider = strings.Split(parts[1], ".")[0]
+	}
+	provider = provider[:min(2, len(provider))]
 
 	emailhash := md5.Sum([]byte(email))
 	shorthash := hex.EncodeToString(emailhash[:])[:8]
 	return prefix + "_" + provider + "_" + shorthash
 }
 
-func (s TinodeService) userToken(user, pass string) (string, error) {
-	rID := uuid.NewString()
-
-	req := &pbx.ClientMsg{Message: &pbx.ClientMsg_Login{
-		Login: &pbx.ClientLogin{
-			Id:     rID,
-			Scheme: "basic",
-			Secret: []byte(user + ":" + pass),
-		},
-	}}
-
-	rawres, err := s.send(rID, req)
-	if err != nil {
-		slog.Error("failed to send login message", "error", err, "id", rID)
-		return "", err
-	}
-
-	res, ok := rawres.(*pbx.ServerMsg_Ctrl)
-	if !ok {
-		slog.Error("failed to project type to ServerMsg_Ctrl", "id", rID, "res", rawres)
-		return "", errors.New("unexpected response from event loop")
-	}
-	slog.Debug("received response from event loop", "res", res)
-
-	if res.Ctrl.Code != 200 {
-		slog.Error("unexpected response code", "code", res.Ctrl.Code, "res", res)
-		return "", errors.New("unexpected response code")
-	}
-
-	return string(res.Ctrl.Params["token"]), nil
-}
-
-func (s TinodeService) joinTopic(topicID string) (err error) {
+// joinTopic subscribes the session to the topic, creating it with the default access mode if it does not exist
+func (s TinodeService) joinTopic(ctx context.Context, r requester, topicID string) (err error) {
 	rID := uuid.NewString()
 
 	msg := &pbx.ClientMsg{Message: &pbx.ClientMsg_Sub{
@@ -431,73 +593,24 @@ func (s TinodeService) joinTopic(topicID string) (err error) {
 			Topic: topicID,
 			SetQuery: &pbx.SetQuery{
 				Desc: &pbx.SetDesc{
-					DefaultAcs: &pbx.DefaultAcsMode{
-						Auth: "JRWPA",
-						Anon: "N",
-					},
+					DefaultAcs: defaultAcs(defaultAccess),
 				},
 			},
 		},
 	}}
 
-	rawres, err := s.send(rID, msg)
+	rawres, err := r.send(ctx, rID, msg)
 	if err != nil {
 		slog.Error("failed to send topic creation message", "error", err, "id", rID)
 		return err
 	}
 
-	res, ok := rawres.(*pbx.ServerMsg_Ctrl)
-	if !ok {
-		slog.Error("failed to project type to ServerMsg_Ctrl", "id", rID, "res", rawres)
-		return errors.New("unexpected response from event loop")
-	}
-	slog.Debug("received response from event loop", "res", res)
-
-	if res.Ctrl.Code != 200 {
-		return errors.New("unexpected response code")
-	}
-
-	return nil
-}
-
-func (s TinodeService) switchUser(accessUUID string) (err error) {
-	rID := uuid.NewString()
-	token, err := s.kv.Get(accessUUID + ":token")
-	if err != nil {
-		slog.Error("failed to get token", "error", err)
-		return err
-	}
-
-	req := &pbx.ClientMsg{Message: &pbx.ClientMsg_Login{
-		Login: &pbx.ClientLogin{
-			Id:     rID,
-			Scheme: "token",
-			Secret: []byte(token),
-		},
-	}}
-
-	rawres, err := s.send(rID, req)
-	if err != nil {
-		slog.Error("failed to send login message", "error", err, "id", rID)
-		return err
-	}
-
-	res, ok := rawres.(*pbx.ServerMsg_Ctrl)
-	if !ok {
-		slog.Error("failed to project type to ServerMsg_Ctrl", "id", rID, "res", rawres)
-		return errors.New("unexpected response from event loop")
-	}
-	slog.Debug("received response from event loop", "res", res)
-
-	if res.Ctrl.Code != 200 {
-		slog.Error("unexpected response code", "code", res.Ctrl.Code, "res", res)
-		return errors.New("unexpected response code")
-	}
-
-	return nil
+	_, err = subResult(rID, rawres)
+	return err
 }
 
-func (s TinodeService) getLastMsgID() (int32, error) {
+// getLastMsgID returns the seq ID of the latest message in the general topic
+func (s TinodeService) getLastMsgID(ctx context.Context, r requester) (int32, error) {
 	rID := uuid.NewString()
 
 	msg := &pbx.ClientMsg{Message: &pbx.ClientMsg_Get{
@@ -510,18 +623,19 @@ func (s TinodeService) getLastMsgID() (int32, error) {
 		},
 	}}
 
-	rawres, err := s.send(rID, msg)
+	rawres, err := r.send(ctx, rID, msg)
 	if err != nil {
 		slog.Error("failed to send message", "error", err, "id", rID)
 		return 0, err
 	}
 
-	res, ok := rawres.(*pbx.ServerMsg_Meta)
-	if !ok {
-		slog.Error("failed to project type to ServerMsg_Ctrl", "id", rID, "res", rawres)
-		return 0, errors.New("unexpected response from event loop")
+	res, err := metaResult(rID, rawres)
+	if err != nil {
+		return 0, err
+	}
+	if res.Desc == nil {
+		return 0, nil
 	}
-	slog.Debug("received response from event loop", "res", res)
 
-	return res.Meta.Desc.SeqId, nil
+	return res.Desc.SeqId, nil
 }
@@ -0,0 +1,31 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateUsername(t *testing.T) {
+	tests := []struct {
+		email  string
+		prefix string
+	}{
+		{email: "john@gmail.com", prefix: "john_gm_"},
+		{email: " John@Gmail.com\n", prefix: "john_gm_"},
+		{email: "a@b.io", prefix: "a_b_"},
+		{email: "a@b", prefix: "a_b_"},
+		{email: "nodomain", prefix: "nodomain__"},
+	}
+
+	for _, tt := range tests {
+		username := generateUsername(tt.email)
+		if !strings.HasPrefix(username, tt.prefix) || len(username) != len(tt.prefix)+8 {
+			t.Errorf("generateUsername(%q) = %q, want %q followed by 8 hash characters", tt.email, username, tt.prefix)
+		}
+	}
+
+	// the username is the login, so accounts registered before must keep theirs
+	if got := generateUsername("john@gmail.com"); got != "john_gm_1f9d9a9e" {
+		t.Errorf("generateUsername(%q) = %q, want %q", "john@gmail.com", got, "john_gm_1f9d9a9e")
+	}
+}
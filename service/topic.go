@@ -0,0 +1,499 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/dartt0n/realtime-chat-backend/forms"
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"github.com/google/uuid"
+	"github.com/tinode/chat/pbx"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+)
+
+// defaultAccess is the default access mode of accounts and topics created by the service:
+// authenticated users may join, read, write, get presence and approve, anonymous users have no access
+var defaultAccess = models.TopicAccess{Auth: "JRWPA", Anon: "N"}
+
+// defaultAcs converts a topic access mode into its Tinode representation
+func defaultAcs(access models.TopicAccess) *pbx.DefaultAcsMode {
+	return &pbx.DefaultAcsMode{
+		Auth: access.Auth,
+		Anon: access.Anon,
+	}
+}
+
+// Tinode access mode bits, as stored in the database
+const (
+	modeJoin int64 = 1 << iota
+	modeRead
+	modeWrite
+	modePres
+	modeApprove
+	modeShare
+	modeDelete
+	modeOwner
+)
+
+// modeLetters are the letters of the access mode bits, in the order of the bits
+const modeLetters = "JRWPASDO"
+
+// modeString converts access mode bits into Tinode's string representation, e.g. "JRWPA"
+func modeString(mode int64) string {
+	var b strings.Builder
+	for i, letter := range modeLetters {
+		if mode&(1<<i) != 0 {
+			b.WriteRune(letter)
+		}
+	}
+	if b.Len() == 0 {
+		return "N"
+	}
+	return b.String()
+}
+
+// effectiveMode returns the access mode both wanted by the user and given by the topic
+func effectiveMode(want, given string) string {
+	var b strings.Builder
+	for _, letter := range modeLetters {
+		if strings.ContainsRune(want, letter) && strings.ContainsRune(given, letter) {
+			b.WriteRune(letter)
+		}
+	}
+	if b.Len() == 0 {
+		return "N"
+	}
+	return b.String()
+}
+
+// topicPublic is the public description of a group topic, as understood by Tinode clients
+type topicPublic struct {
+	Fn   string `json:"fn"`
+	Note string `json:"note,omitempty"`
+}
+
+// topicRecord is the part of Tinode's topic document the service reads from the database
+type topicRecord struct {
+	ID     string `bson:"_id"`
+	Owner  string `bson:"owner"`
+	Access struct {
+		Auth int64 `bson:"auth"`
+		Anon int64 `bson:"anon"`
+	} `bson:"access"`
+	Aux struct {
+		Pins []int32 `bson:"pins"`
+	} `bson:"aux"`
+}
+
+// CreateTopic creates a new group topic owned by the user, the user's session is subscribed to it
+func (s TinodeService) CreateTopic(ctx context.Context, accessUUID string, userID models.UserID, form forms.CreateTopicForm) (topic models.Topic, err error) {
+	rID := uuid.NewString()
+
+	sess, err := s.sessions.Get(ctx, accessUUID)
+	if err != nil {
+		return topic, err
+	}
+
+	access := defaultAccess
+	if form.Auth != "" {
+		access.Auth = form.Auth
+	}
+	if form.Anon != "" {
+		access.Anon = form.Anon
+	}
+
+	public, err := json.Marshal(topicPublic{Fn: form.Name, Note: form.Description})
+	if err != nil {
+		return topic, err
+	}
+
+	msg := &pbx.ClientMsg{Message: &pbx.ClientMsg_Sub{
+		Sub: &pbx.ClientSub{
+			Id:    rID,
+			Topic: "new",
+			SetQuery: &pbx.SetQuery{
+				Desc: &pbx.SetDesc{
+					DefaultAcs: defaultAcs(access),
+					Public:     public,
+				},
+			},
+		},
+	}}
+
+	rawres, err := sess.send(ctx, rID, msg)
+	if err != nil {
+		slog.Error("failed to send topic creation message", "error", err, "id", rID)
+		return topic, err
+	}
+
+	res, err := ctrlResult(rID, rawres)
+	if err != nil {
+		return topic, err
+	}
+
+	topic = models.Topic{
+		ID:          res.Topic,
+		Name:        form.Name,
+		Description: form.Description,
+		Owner:       userID,
+		Access:      access,
+	}
+
+	var acs struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.Unmarshal(res.Params["acs"], &acs); err == nil {
+		topic.Mode = acs.Mode
+	}
+
+	return topic, nil
+}
+
+// ListTopics returns the group topics the user is subscribed to
+func (s TinodeService) ListTopics(ctx context.Context, accessUUID string) ([]models.Topic, error) {
+	sess, err := s.sessions.Get(ctx, accessUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	subs, err := topicSubs(ctx, sess, "me")
+	if err != nil {
+		return nil, err
+	}
+
+	topics := make([]models.Topic, 0, len(subs))
+	ids := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		if !strings.HasPrefix(sub.Topic, "grp") {
+			continue
+		}
+
+		var public topicPublic
+		if len(sub.Public) > 0 {
+			if err := json.Unmarshal(sub.Public, &public); err != nil {
+				slog.Warn("failed to parse topic public", "error", err, "topic", sub.Topic)
+			}
+		}
+		if public.Fn == "" && sub.Topic == s.topic.ID {
+			public.Fn = s.topic.Name
+		}
+
+		topic := models.Topic{ID: sub.Topic, Name: public.Fn, Description: public.Note}
+		if sub.Acs != nil {
+			topic.Mode = effectiveMode(sub.Acs.Want, sub.Acs.Given)
+		}
+		topics = append(topics, topic)
+		ids = append(ids, sub.Topic)
+	}
+	if len(ids) == 0 {
+		return topics, nil
+	}
+
+	// owners and default access are not part of the subscription, they are read from Tinode's database
+	cursor, err := s.history.Collection("topics").Find(ctx, bson.D{bson.E{Key: "_id", Value: bson.D{bson.E{Key: "$in", Value: ids}}}})
+	if err != nil {
+		slog.Error("failed to fetch topics", "error", err)
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var records []topicRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		slog.Error("failed to fetch all topics", "error", err)
+		return nil, err
+	}
+
+	byID := make(map[string]topicRecord, len(records))
+	for _, rec := range records {
+		byID[rec.ID] = rec
+	}
+	for i := range topics {
+		rec, ok := byID[topics[i].ID]
+		if !ok {
+			continue
+		}
+		if rec.Owner != "" {
+			topics[i].Owner = models.UserID("usr" + rec.Owner)
+		}
+		topics[i].Access = models.TopicAccess{Auth: modeString(rec.Access.Auth), Anon: modeString(rec.Access.Anon)}
+		topics[i].Pins = rec.Aux.Pins
+	}
+
+	return topics, nil
+}
+
+// JoinTopic subscribes the user to an existing group topic
+func (s TinodeService) JoinTopic(ctx context.Context, accessUUID, topicID string) error {
+	sess, err := s.sessions.Get(ctx, accessUUID)
+	if err != nil {
+		return err
+	}
+
+	return attachTopic(ctx, sess, topicID)
+}
+
+// LeaveTopic unsubscribes the user from the topic, the user stops receiving its messages
+func (s TinodeService) LeaveTopic(ctx context.Context, accessUUID, topicID string) error {
+	rID := uuid.NewString()
+
+	sess, err := s.sessions.Get(ctx, accessUUID)
+	if err != nil {
+		return err
+	}
+
+	msg := &pbx.ClientMsg{Message: &pbx.ClientMsg_Leave{
+		Leave: &pbx.ClientLeave{
+			Id:    rID,
+			Topic: topicID,
+			Unsub: true,
+		},
+	}}
+
+	rawres, err := sess.send(ctx, rID, msg)
+	if err != nil {
+		slog.Error("failed to send leave message", "error", err, "id", rID)
+		return err
+	}
+
+	_, err = ctrlResult(rID, rawres)
+	return err
+}
+
+// checkAccess returns ErrForbidden unless the user's subscription to the topic grants all bits of mode.
+// The message history is read from the database directly, bypassing Tinode's own access checks.
+func (s TinodeService) checkAccess(ctx context.Context, userID models.UserID, topicID string, mode int64) error {
+	given, err := s.subscriptionMode(ctx, userID, topicID)
+	if err != nil {
+		return err
+	}
+
+	if given&mode != mode {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// subscriptionMode returns the access mode of the user's subscription to the topic, wanted by the user and given by the topic.
+// Returns ErrForbidden if the user is not subscribed.
+func (s TinodeService) subscriptionMode(ctx context.Context, userID models.UserID, topicID string) (int64, error) {
+	var sub struct {
+		Want  int64 `bson:"modewant"`
+		Given int64 `bson:"modegiven"`
+	}
+
+	// access must not lag behind joins and leaves, so it is checked on the primary
+	subs := s.history.Collection("subscriptions", options.Collection().SetReadPreference(readpref.Primary()))
+	filter := bson.D{
+		bson.E{Key: "_id", Value: topicID + ":" + strings.TrimPrefix(string(userID), "usr")},
+		bson.E{Key: "deletedat", Value: nil},
+	}
+	err := subs.FindOne(ctx, filter).Decode(&sub)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, ErrForbidden
+	}
+	if err != nil {
+		slog.Error("failed to fetch subscription", "error", err, "topic", topicID, "user", userID)
+		return 0, err
+	}
+
+	return sub.Want & sub.Given, nil
+}
+
+// moderators returns which of the users moderate the topic, i.e. may delete messages of others.
+// users are bare user IDs, as stored in messages.
+func (s TinodeService) moderators(ctx context.Context, topicID string, users []string) (map[string]bool, error) {
+	mods := make(map[string]bool, len(users))
+	if len(users) == 0 {
+		return mods, nil
+	}
+
+	ids := make([]string, len(users))
+	for i, u := range users {
+		ids[i] = topicID + ":" + u
+	}
+	filter := bson.D{
+		bson.E{Key: "_id", Value: bson.D{bson.E{Key: "$in", Value: ids}}},
+		bson.E{Key: "deletedat", Value: nil},
+	}
+	cursor, err := s.history.Collection("subscriptions").Find(ctx, filter)
+	if err != nil {
+		slog.Error("failed to fetch subscriptions", "error", err, "topic", topicID)
+		return nil, err
+	}
+	defer cursor.Close(context.Background())
+
+	var subs []struct {
+		User  string `bson:"user"`
+		Want  int64  `bson:"modewant"`
+		Given int64  `bson:"modegiven"`
+	}
+	if err := cursor.All(ctx, &subs); err != nil {
+		slog.Error("failed to fetch all subscriptions", "error", err)
+		return nil, err
+	}
+
+	for _, sub := range subs {
+		mods[sub.User] = isModerator(sub.Want & sub.Given)
+	}
+	return mods, nil
+}
+
+// isModerator reports whether the access mode allows deleting messages of others
+func isModerator(mode int64) bool {
+	return mode&(modeDelete|modeOwner) != 0
+}
+
+// attachTopic subscribes the session to an existing topic
+func attachTopic(ctx context.Context, r requester, topicID string) error {
+	rID := uuid.NewString()
+
+	msg := &pbx.ClientMsg{Message: &pbx.ClientMsg_Sub{
+		Sub: &pbx.ClientSub{
+			Id:    rID,
+			Topic: topicID,
+		},
+	}}
+
+	rawres, err := r.send(ctx, rID, msg)
+	if err != nil {
+		slog.Error("failed to send subscription message", "error", err, "id", rID)
+		return err
+	}
+
+	_, err = subResult(rID, rawres)
+	return err
+}
+
+// subResult asserts that the response to a sub message is successful,
+// subscribing a session that is already attached to the topic is not an error
+func subResult(rID string, rawres any) (*pbx.ServerCtrl, error) {
+	if res, ok := rawres.(*pbx.ServerMsg_Ctrl); ok && res.Ctrl.Code == http.StatusNotModified {
+		return res.Ctrl, nil
+	}
+	return ctrlResult(rID, rawres)
+}
+
+// topicSubs returns the subscriptions of the topic, for the "me" topic these are the topics the user is subscribed to
+func topicSubs(ctx context.Context, r requester, topicID string) ([]*pbx.TopicSub, error) {
+	rID := uuid.NewString()
+
+	msg := &pbx.ClientMsg{Message: &pbx.ClientMsg_Get{
+		Get: &pbx.ClientGet{
+			Id:    rID,
+			Topic: topicID,
+			Query: &pbx.GetQuery{
+				What: "sub",
+			},
+		},
+	}}
+
+	rawres, err := r.send(ctx, rID, msg)
+	if err != nil {
+		slog.Error("failed to send get subscriptions message", "error", err, "id", rID)
+		return nil, err
+	}
+
+	res, err := metaResult(rID, rawres)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Sub, nil
+}
+
+// SendDirectMessage publishes a message to the peer-to-peer topic of the user and the peer,
+// the topic is created with the default access mode on the first message
+func (s TinodeService) SendDirectMessage(ctx context.Context, accessUUID string, userID, peer models.UserID, replyTo int32, content models.Content) error {
+	topicID, err := models.P2PTopicID(userID, peer)
+	if err != nil {
+		return err
+	}
+
+	sess, err := s.sessions.Get(ctx, accessUUID)
+	if err != nil {
+		return err
+	}
+
+	// Tinode addresses the peer-to-peer topic by the ID of the other user
+	if err := s.joinTopic(ctx, sess, string(peer)); err != nil {
+		return err
+	}
+
+	return s.sendMessage(ctx, accessUUID, string(peer), topicID, replyTo, content)
+}
+
+// FetchDirectMsgs returns a page of the peer-to-peer history of the user and the peer
+func (s TinodeService) FetchDirectMsgs(ctx context.Context, userID, peer models.UserID, query forms.HistoryQuery) (page models.MessagePage, err error) {
+	topicID, err := models.P2PTopicID(userID, peer)
+	if err != nil {
+		return page, err
+	}
+
+	return s.FetchMsgs(ctx, userID, topicID, query)
+}
+
+// MarkRead reports that the user has read the topic's messages up to seq, other subscribers are notified
+func (s TinodeService) MarkRead(ctx context.Context, accessUUID, topicID string, seq int32) error {
+	return s.note(ctx, accessUUID, topicID, pbx.InfoNote_READ, seq)
+}
+
+// MarkRecv reports that the user's client has received the topic's messages up to seq, other subscribers are notified
+func (s TinodeService) MarkRecv(ctx context.Context, accessUUID, topicID string, seq int32) error {
+	return s.note(ctx, accessUUID, topicID, pbx.InfoNote_RECV, seq)
+}
+
+// note sends a notification to the topic on behalf of the user, Tinode does not respond to notes
+func (s TinodeService) note(ctx context.Context, accessUUID, topicID string, what pbx.InfoNote, seq int32) error {
+	sess, err := s.sessions.Get(ctx, accessUUID)
+	if err != nil {
+		return err
+	}
+
+	return sess.notify(&pbx.ClientMsg{Message: &pbx.ClientMsg_Note{
+		Note: &pbx.ClientNote{
+			Topic: topicID,
+			What:  what,
+			SeqId: seq,
+		},
+	}})
+}
+
+// UnreadCounts returns the number of unread messages per topic the user is subscribed to,
+// peer-to-peer topics are keyed by the ID of the other user
+func (s TinodeService) UnreadCounts(ctx context.Context, accessUUID string) (map[string]int32, error) {
+	sess, err := s.sessions.Get(ctx, accessUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	subs, err := topicSubs(ctx, sess, "me")
+	if err != nil {
+		return nil, err
+	}
+
+	unread := make(map[string]int32, len(subs))
+	for _, sub := range subs {
+		if !strings.HasPrefix(sub.Topic, "grp") && !strings.HasPrefix(sub.Topic, "usr") {
+			continue
+		}
+		// SeqId is the latest message of the topic, ReadId the latest one read by the user
+		unread[sub.Topic] = max(sub.SeqId-sub.ReadId, 0)
+	}
+	return unread, nil
+}
+
+// Typing notifies other subscribers of the topic that the user is typing.
+// Notifications sent more often than Tinode clients send them are dropped.
+func (s TinodeService) Typing(ctx context.Context, accessUUID, topicID string) error {
+	if !s.typing.allow(accessUUID + ":" + topicID) {
+		return nil
+	}
+	return s.note(ctx, accessUUID, topicID, pbx.InfoNote_KP, 0)
+}
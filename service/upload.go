@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/dartt0n/realtime-chat-backend/blob"
+	"github.com/dartt0n/realtime-chat-backend/models"
+	"github.com/google/uuid"
+)
+
+// UploadService stores files attached to messages, access to them follows the access to their topic
+type UploadService struct {
+	blobs  blob.BlobStore
+	tinode *TinodeService
+}
+
+func NewUploadService(blobs blob.BlobStore, tinode *TinodeService) *UploadService {
+	return &UploadService{blobs: blobs, tinode: tinode}
+}
+
+// uploadURL returns the path the blob is downloaded from
+func uploadURL(key string) string {
+	return "/uploads/" + key
+}
+
+// Upload stores a file to be attached to messages of the topic.
+// The returned attachment's URL is the reference to put into the "ref" of a Drafty EX or IM entity.
+func (s UploadService) Upload(ctx context.Context, userID models.UserID, topicID string, r io.Reader, info blob.Info) (models.Attachment, error) {
+	if err := s.tinode.checkAccess(ctx, userID, topicID, modeWrite); err != nil {
+		return models.Attachment{}, err
+	}
+
+	key := topicID + "/" + uuid.NewString()
+	if err := s.blobs.Put(ctx, key, r, info); err != nil {
+		slog.Error("failed to store upload", "error", err, "topic", topicID, "key", key)
+		return models.Attachment{}, err
+	}
+
+	return models.Attachment{Name: info.Name, MIME: info.MIME, Size: info.Size, URL: uploadURL(key)}, nil
+}
+
+// Download opens a file attached to messages of the topic, the user must be allowed to read the topic
+func (s UploadService) Download(ctx context.Context, userID models.UserID, topicID, id string) (io.ReadCloser, blob.Info, error) {
+	if err := s.tinode.checkAccess(ctx, userID, topicID, modeRead); err != nil {
+		return nil, blob.Info{}, err
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, blob.Info{}, ErrNotFound
+	}
+
+	r, info, err := s.blobs.Get(ctx, topicID+"/"+id)
+	if errors.Is(err, blob.ErrNotFound) {
+		return nil, info, ErrNotFound
+	}
+	if err != nil {
+		slog.Error("failed to open upload", "error", err, "topic", topicID, "id", id)
+	}
+	return r, info, err
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dartt0n/realtime-chat-backend/kv"
+	"github.com/dartt0n/realtime-chat-backend/mail"
+	"github.com/dartt0n/realtime-chat-backend/models"
+)
+
+const (
+	// verifyTokenTTL is how long a verification token can be used
+	verifyTokenTTL = 24 * time.Hour
+	// verifyResendInterval is the minimal interval between verification emails sent to a user
+	verifyResendInterval = time.Minute
+)
+
+// VerifyService verifies that users own the email they signed up with: a single-use token
+// is mailed to the address and the user can not log in until the token is submitted
+type VerifyService struct {
+	kv     kv.KeyValueStore
+	mailer mail.Mailer
+	link   string // URL of the verification page, the token is appended as a query parameter
+}
+
+// NewVerifyService creates a VerifyService sending tokens through the mailer.
+// link: URL of the frontend page submitting the token, empty to send the bare token
+func NewVerifyService(kv kv.KeyValueStore, mailer mail.Mailer, link string) *VerifyService {
+	return &VerifyService{kv: kv, mailer: mailer, link: link}
+}
+
+// verifyPendingKey returns the key whose existence blocks the login of the user, it holds the email to verify
+func verifyPendingKey(userID models.UserID) string {
+	return "verify:pending:" + userID.String()
+}
+
+// verifyTokenKey returns the key of the user a verification token was sent to
+func verifyTokenKey(token string) string {
+	return "verify:token:" + token
+}
+
+// verifyEmailKey returns the key of the unverified user registered with the email
+func verifyEmailKey(email string) string {
+	return "verify:email:" + normalizeEmail(email)
+}
+
+// normalizeEmail returns the email in the form usernames are generated from
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// randomToken returns a random URL-safe token
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// verificationPending reports whether the user has not verified the email yet.
+// Users registered before verification was introduced have nothing pending.
+func verificationPending(kv kv.KeyValueStore, userID models.UserID) bool {
+	_, err := kv.Get(verifyPendingKey(userID))
+	return err == nil
+}
+
+// Start blocks the login of a newly registered user until the email is verified and mails the first token
+func (s VerifyService) Start(ctx context.Context, user models.User) error {
+	if err := s.kv.Set(verifyPendingKey(user.ID), normalizeEmail(user.Email), 0); err != nil {
+		return err
+	}
+	if err := s.kv.Set(verifyEmailKey(user.Email), user.ID.String(), 0); err != nil {
+		return err
+	}
+	return s.send(ctx, user.ID, user.Email)
+}
+
+// send mails a new verification token to the user
+func (s VerifyService) send(ctx context.Context, userID models.UserID, email string) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if err := s.kv.Set(verifyTokenKey(token), userID.String(), verifyTokenTTL); err != nil {
+		return err
+	}
+
+	body := "Welcome!\n\nPlease confirm your email address with the following code:\n\n" + token + "\n"
+	if s.link != "" {
+		body += "\nor open this link:\n\n" + s.link + "?token=" + url.QueryEscape(token) + "\n"
+	}
+	body += "\nThe code expires in 24 hours. If you did not sign up, please ignore this email.\n"
+
+	return s.mailer.Send(ctx, mail.Message{To: email, Subject: "Verify your email", Body: body})
+}
+
+// Verify marks the email of the user the token was sent to as verified, tokens can be used once
+func (s VerifyService) Verify(token string) (models.UserID, error) {
+	raw, err := s.kv.Get(verifyTokenKey(token))
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	// deletion succeeds only once, so a token can not be used twice
+	if _, err := s.kv.Del(verifyTokenKey(token)); err != nil {
+		return "", ErrInvalidToken
+	}
+	userID, err := models.ParseUserID(raw)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	// tokens of an already verified user are consumed without effect
+	if email, err := s.kv.Get(verifyPendingKey(userID)); err == nil {
+		s.kv.Del(verifyEmailKey(email))
+		if _, err := s.kv.Del(verifyPendingKey(userID)); err != nil {
+			return "", err
+		}
+		slog.Info("email verified", "user_id", userID)
+	}
+	return userID, nil
+}
+
+// Resend mails a new token if the email belongs to a user who has not verified it yet.
+// Unknown and verified emails, and requests sent too often, are ignored, so the response
+// does not reveal whether the email is registered.
+func (s VerifyService) Resend(ctx context.Context, email string) error {
+	raw, err := s.kv.Get(verifyEmailKey(email))
+	if err != nil {
+		return nil
+	}
+	userID, err := models.ParseUserID(raw)
+	if err != nil {
+		return nil
+	}
+
+	allowed, err := s.kv.SetNX("verify:resend:"+userID.String(), "1", verifyResendInterval)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return nil
+	}
+	return s.send(ctx, userID, email)
+}
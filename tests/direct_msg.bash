@@ -0,0 +1,12 @@
+#!/bin/bash
+
+# send a direct message to the user given by PEER, e.g. usrAbCdEfGhIjK
+curl --request POST \
+    --url http://localhost:8080/users/$PEER/messages \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Content-Type: application/json' \
+    --data '{"content": "hello there!"}'
+
+curl --request GET \
+    --url http://localhost:8080/users/$PEER/messages \
+    --header 'Authorization: Bearer '$TOKEN''
@@ -0,0 +1,19 @@
+#!/bin/bash
+
+# Markdown is converted to Drafty, send "format": "plain" to keep the text as is
+curl --request POST \
+    --url http://localhost:8080/message \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Content-Type: application/json' \
+    --data '{"content": "**hello** _world_, see [the docs](https://tinode.co) and \"quotes\" \\ too"}'
+
+curl --request POST \
+    --url http://localhost:8080/message \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Content-Type: application/json' \
+    --data '{"drafty": {"txt": "hello world", "fmt": [{"at": 0, "len": 5, "tp": "ST"}]}}'
+
+# history returns the content along with its plain text and HTML
+curl --request GET \
+    --url 'http://localhost:8080/messages?limit=2' \
+    --header 'Authorization: Bearer '$TOKEN''
@@ -0,0 +1,12 @@
+#!/bin/bash
+
+# edit the message given by SEQ, then delete it
+curl --request PATCH \
+    --url http://localhost:8080/messages/$SEQ \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Content-Type: application/json' \
+    --data '{"content": "hello world, edited!"}'
+
+curl --request DELETE \
+    --url http://localhost:8080/messages/$SEQ \
+    --header 'Authorization: Bearer '$TOKEN''
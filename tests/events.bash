@@ -0,0 +1,7 @@
+#!/bin/bash
+
+curl --no-buffer --request GET \
+    --url http://localhost:8080/events \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Accept: text/event-stream' \
+    --header 'Last-Event-ID: '${LAST_EVENT_ID:-0}''
@@ -0,0 +1,5 @@
+#!/bin/bash
+
+# public keys tokens are verified with, the "kid" header of a token names its key
+curl --request GET \
+    --url http://localhost:8080/.well-known/jwks.json
@@ -1,6 +1,7 @@
 #!/bin/bash
 
+# BEFORE takes the next_cursor of the previous page to scroll back in history
 curl --request GET \
-    --url http://localhost:8080/messages \
+    --url 'http://localhost:8080/messages?limit='${LIMIT:-50}''${BEFORE:+'&before='$BEFORE} \
     -H 'Authorization: '$TOKEN'' \
     --header 'User-Agent: insomnia/10.3.0'
@@ -0,0 +1,6 @@
+#!/bin/bash
+
+# list users online in the topic given by TOPIC
+curl --request GET \
+    --url http://localhost:8080/topics/$TOPIC/online \
+    --header 'Authorization: Bearer '$TOKEN''
@@ -0,0 +1,21 @@
+#!/bin/bash
+
+curl --request POST \
+    --url http://localhost:8080/password/forgot \
+    --header 'Content-Type: application/json' \
+    --header 'User-Agent: insomnia/10.3.0' \
+    --data '{ "email": "user4@example.com" }'
+
+# the token is mailed to the user, all sessions are logged out after the reset
+curl --request POST \
+    --url http://localhost:8080/password/reset \
+    --header 'Content-Type: application/json' \
+    --header 'User-Agent: insomnia/10.3.0' \
+    --data '{ "token": "<token>", "password": "n3w$4eba!23eae5a" }'
+
+curl --request POST \
+    --url http://localhost:8080/password/change \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Content-Type: application/json' \
+    --header 'User-Agent: insomnia/10.3.0' \
+    --data '{ "old_password": "n3w$4eba!23eae5a", "new_password": "d0$4eba!23eae5a" }'
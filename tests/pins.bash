@@ -0,0 +1,15 @@
+#!/bin/bash
+
+# pin the message given by SEQ in the topic given by TOPIC, e.g. grpIpFXpGGNaas, moderators only
+curl --request POST \
+    --url http://localhost:8080/topics/$TOPIC/pins/$SEQ \
+    --header 'Authorization: Bearer '$TOKEN''
+
+# pinned messages, the latest pin first, their seq ids are also listed in "pins" of GET /topics
+curl --request GET \
+    --url http://localhost:8080/topics/$TOPIC/pins \
+    --header 'Authorization: Bearer '$TOKEN''
+
+curl --request DELETE \
+    --url http://localhost:8080/topics/$TOPIC/pins/$SEQ \
+    --header 'Authorization: Bearer '$TOKEN''
@@ -0,0 +1,18 @@
+#!/bin/bash
+
+# react to the message given by SEQ in the general topic, use /topics/<id>/messages/$SEQ/reactions for other topics
+curl --request POST \
+    --url http://localhost:8080/messages/$SEQ/reactions \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Content-Type: application/json' \
+    --data '{"emoji": "👍"}'
+
+# history aggregates reactions per message: {"reactions": {"👍": ["usr..."]}}
+curl --request GET \
+    --url 'http://localhost:8080/messages?limit=5' \
+    --header 'Authorization: Bearer '$TOKEN''
+
+# the emoji is URL-encoded in the path
+curl --request DELETE \
+    --url http://localhost:8080/messages/$SEQ/reactions/%F0%9F%91%8D \
+    --header 'Authorization: Bearer '$TOKEN''
@@ -0,0 +1,12 @@
+#!/bin/bash
+
+# mark messages of the topic given by TOPIC as read up to SEQ
+curl --request POST \
+    --url http://localhost:8080/topics/$TOPIC/read \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Content-Type: application/json' \
+    --data '{"seq_id": '$SEQ'}'
+
+curl --request GET \
+    --url http://localhost:8080/topics/unread \
+    --header 'Authorization: Bearer '$TOKEN''
@@ -0,0 +1,13 @@
+#!/bin/bash
+
+# exchange the refresh token given by REFRESH for a new pair, the old pair stops working
+curl --request POST \
+    --url http://localhost:8080/refresh \
+    --header 'Content-Type: application/json' \
+    --data '{ "refresh_token": "'$REFRESH'" }'
+
+# using the same refresh token again is treated as theft: all tokens of the login are revoked
+curl --request POST \
+    --url http://localhost:8080/refresh \
+    --header 'Content-Type: application/json' \
+    --data '{ "refresh_token": "'$REFRESH'" }'
@@ -0,0 +1,32 @@
+#!/bin/bash
+
+# publish a message to the topic given by TOPIC once, at send_at (RFC 3339)
+curl --request POST \
+    --url http://localhost:8080/messages/scheduled \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Content-Type: application/json' \
+    --data '{
+  "topic": "'$TOPIC'",
+  "content": "Reminder: **standup** in 5 minutes",
+  "send_at": "'$(date -u -d '+1 minute' +%Y-%m-%dT%H:%M:%SZ)'"
+}'
+
+# publish a message to the general topic every weekday at 9:00 Moscow time
+curl --request POST \
+    --url http://localhost:8080/messages/scheduled \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Content-Type: application/json' \
+    --data '{
+  "content": "Good morning!",
+  "cron": "CRON_TZ=Europe/Moscow 0 9 * * 1-5"
+}'
+
+# scheduled messages of the user, the next to be published first
+curl --request GET \
+    --url http://localhost:8080/messages/scheduled \
+    --header 'Authorization: Bearer '$TOKEN''
+
+# cancel the scheduled message given by ID
+curl --request DELETE \
+    --url http://localhost:8080/messages/scheduled/$ID \
+    --header 'Authorization: Bearer '$TOKEN''
@@ -0,0 +1,16 @@
+#!/bin/bash
+
+# search messages in all topics the user may read, optionally limited to a topic (grp... or usr...) and an author
+curl --request GET \
+    --url 'http://localhost:8080/search?q=hello&limit=10' \
+    --header 'Authorization: Bearer '$TOKEN''
+
+# the next page, CURSOR is the next_cursor of the previous page
+curl --request GET \
+    --url 'http://localhost:8080/search?q=hello&limit=10&cursor='$CURSOR'' \
+    --header 'Authorization: Bearer '$TOKEN''
+
+# messages sent in a date range, since is inclusive and until exclusive
+curl --request GET \
+    --url 'http://localhost:8080/search?q=hello&since=2024-01-01T00:00:00Z&until=2024-02-01T00:00:00Z' \
+    --header 'Authorization: Bearer '$TOKEN''
@@ -0,0 +1,16 @@
+#!/bin/bash
+
+# active sessions of the user, the most recently used first, "current" marks the one of TOKEN
+curl --request GET \
+    --url http://localhost:8080/sessions \
+    --header 'Authorization: Bearer '$TOKEN''
+
+# log out of the session given by ID, e.g. a lost device
+curl --request DELETE \
+    --url http://localhost:8080/sessions/$ID \
+    --header 'Authorization: Bearer '$TOKEN''
+
+# log out everywhere, including this session
+curl --request DELETE \
+    --url http://localhost:8080/sessions \
+    --header 'Authorization: Bearer '$TOKEN''
@@ -0,0 +1,18 @@
+#!/bin/bash
+
+# reply to the message given by SEQ in the general topic, replies to replies join the same thread
+curl --request POST \
+    --url http://localhost:8080/message \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Content-Type: application/json' \
+    --data '{"content": "replying in a thread", "reply_to": '$SEQ'}'
+
+# the thread root with a page of replies, paged like the history
+curl --request GET \
+    --url 'http://localhost:8080/messages/'$SEQ'/thread?limit=20' \
+    --header 'Authorization: Bearer '$TOKEN''
+
+# top-level history shows "replies" and "last_reply_at" on thread roots
+curl --request GET \
+    --url 'http://localhost:8080/messages?limit=5' \
+    --header 'Authorization: Bearer '$TOKEN''
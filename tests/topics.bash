@@ -0,0 +1,20 @@
+#!/bin/bash
+
+# create a group topic, the response contains its id
+curl --request POST \
+    --url http://localhost:8080/topics \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Content-Type: application/json' \
+    --data '{"name": "random", "description": "Off-topic discussions"}'
+
+# list topics of the user
+curl --request GET \
+    --url http://localhost:8080/topics \
+    --header 'Authorization: Bearer '$TOKEN''
+
+# send a message to the topic given by TOPIC
+curl --request POST \
+    --url http://localhost:8080/topics/$TOPIC/messages \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --header 'Content-Type: application/json' \
+    --data '{"content": "hello random!"}'
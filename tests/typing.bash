@@ -0,0 +1,6 @@
+#!/bin/bash
+
+# notify the topic given by TOPIC that the user is typing
+curl --request POST \
+    --url http://localhost:8080/topics/$TOPIC/typing \
+    --header 'Authorization: Bearer '$TOKEN''
@@ -0,0 +1,13 @@
+#!/bin/bash
+
+# upload a file to the general topic, pass topic=<grp...|usr...> for other topics
+curl --request POST \
+    --url http://localhost:8080/uploads \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --form 'file=@README.md;type=text/markdown'
+
+# attach the returned url to a message as the "ref" of a Drafty EX entity, then download it
+curl --request GET \
+    --url http://localhost:8080$UPLOAD_URL \
+    --header 'Authorization: Bearer '$TOKEN'' \
+    --output /tmp/upload.out
@@ -0,0 +1,14 @@
+#!/bin/bash
+
+# the token is mailed to the user after signup
+curl --request POST \
+    --url http://localhost:8080/verify \
+    --header 'Content-Type: application/json' \
+    --header 'User-Agent: insomnia/10.3.0' \
+    --data '{ "token": "<token>" }'
+
+curl --request POST \
+    --url http://localhost:8080/verify/resend \
+    --header 'Content-Type: application/json' \
+    --header 'User-Agent: insomnia/10.3.0' \
+    --data '{ "email": "user4@example.com" }'